@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ackStore keeps a cursor of unacknowledged messages for each ack-mode
+// subscriber, so that messages lost with a connection are redelivered when
+// it reconnects. Messages published to a path with cursors get IDs from
+// one server-wide sequence.
+type ackStore struct {
+	sync.Mutex
+	next    uint64
+	cursors map[string]map[cursorKey]*cursor // by path
+	swept   time.Time
+}
+
+// cursorKey identifies a subscriber by the stable ID it chose, scoped to
+// its authenticated identity so that one user can't take over another's
+// cursor.
+type cursorKey struct {
+	identity   string
+	subscriber string
+}
+
+type cursor struct {
+	pending []message // in ID order
+	conns   int       // connections attached
+	left    time.Time // when the last connection detached
+}
+
+func newAckStore() *ackStore {
+	return &ackStore{cursors: make(map[string]map[cursorKey]*cursor)}
+}
+
+// ackParams parses the ack and subscriber connect parameters.
+func ackParams(q url.Values) (bool, string, error) {
+	if !q.Has("ack") {
+		return false, "", nil
+	}
+	if q.Get("subscriber") == "" {
+		return false, "", errors.New("ack requires a subscriber ID")
+	}
+	return true, q.Get("subscriber"), nil
+}
+
+// parseAck returns the ID acknowledged by a client message such as
+// {"ack":42}.
+func parseAck(text []byte) (uint64, bool) {
+	var a struct {
+		Ack *uint64 `json:"ack"`
+	}
+	if json.Unmarshal(text, &a) != nil || a.Ack == nil {
+		return 0, false
+	}
+	return *a.Ack, true
+}
+
+// record gives msg an ID and adds it to every cursor of path, connected
+// or not. Paths without cursors are left alone.
+func (s *ackStore) record(cfg *config, path string, msg message) message {
+	s.Lock()
+	defer s.Unlock()
+	s.sweep(cfg, time.Now())
+	if len(s.cursors[path]) == 0 {
+		return msg
+	}
+	s.next++
+	msg.id = s.next
+	now := time.Now()
+	for _, cur := range s.cursors[path] {
+		cur.prune(now)
+		if len(cur.pending) == cfg.AckMaxPending {
+			cur.pending = append(cur.pending[:0], cur.pending[1:]...)
+			mark("ackdrops", 1)
+		}
+		cur.pending = append(cur.pending, msg)
+	}
+	return msg
+}
+
+// attach connects a subscriber to its cursor, creating it if needed.
+func (s *ackStore) attach(cfg *config, path string, key cursorKey) {
+	s.Lock()
+	defer s.Unlock()
+	s.sweep(cfg, time.Now())
+	if s.cursors[path] == nil {
+		s.cursors[path] = make(map[cursorKey]*cursor)
+	}
+	cur, ok := s.cursors[path][key]
+	if !ok {
+		cur = &cursor{}
+		s.cursors[path][key] = cur
+	}
+	cur.conns++
+	cur.prune(time.Now())
+}
+
+// since returns up to max of a subscriber's unacknowledged messages with
+// IDs after after.
+func (s *ackStore) since(path string, key cursorKey, after uint64, max int) []message {
+	s.Lock()
+	defer s.Unlock()
+	cur, ok := s.cursors[path][key]
+	if !ok {
+		return nil
+	}
+	cur.prune(time.Now())
+	var msgs []message
+	for _, msg := range cur.pending {
+		if len(msgs) == max {
+			break
+		}
+		if msg.id > after {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// prune drops expired messages from the cursor.
+func (cur *cursor) prune(now time.Time) {
+	kept := cur.pending[:0]
+	for _, msg := range cur.pending {
+		if msg.expired(now) {
+			mark("expired", 1)
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	cur.pending = kept
+}
+
+// detach disconnects a subscriber from its cursor, which is then kept for
+// AckRetention.
+func (s *ackStore) detach(path string, key cursorKey) {
+	s.Lock()
+	defer s.Unlock()
+	if cur, ok := s.cursors[path][key]; ok {
+		cur.conns--
+		cur.left = time.Now()
+	}
+}
+
+// ack removes message id from a subscriber's cursor.
+func (s *ackStore) ack(path string, key cursorKey, id uint64) {
+	s.Lock()
+	defer s.Unlock()
+	cur, ok := s.cursors[path][key]
+	if !ok {
+		return
+	}
+	for i, msg := range cur.pending {
+		if msg.id == id {
+			cur.pending = append(cur.pending[:i], cur.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// sweep forgets cursors disconnected for longer than AckRetention, at
+// most once a minute.
+func (s *ackStore) sweep(cfg *config, now time.Time) {
+	if now.Sub(s.swept) < time.Minute {
+		return
+	}
+	s.swept = now
+	for path, cursors := range s.cursors {
+		for key, cur := range cursors {
+			if cur.conns == 0 && now.Sub(cur.left) > cfg.AckRetention.Duration {
+				delete(cursors, key)
+			}
+		}
+		if len(cursors) == 0 {
+			delete(s.cursors, path)
+		}
+	}
+}
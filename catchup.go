@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// catchupPeriod is how often a channel offers more messages to
+// subscribers that are catching up.
+const catchupPeriod = 10 * time.Millisecond
+
+// catchup is a subscriber being sent older messages, such as a durable
+// log replay, before live ones. Each round the channel sends only what
+// fits in the subscriber's send buffer, so it never waits on one
+// subscriber. Live messages skip the subscriber until it has caught up;
+// read returns them too, having stored them first.
+type catchup struct {
+	// read returns up to max more messages to send, or none once the
+	// subscriber has caught up.
+	read func(max int) []message
+
+	pending  []message // read but not yet sent
+	progress time.Time // when a message was last sent
+}
+
+// catchingUp reports whether conn is still catching up.
+func (c *channel) catchingUp(conn *connection) bool {
+	_, ok := c.catchups[conn]
+	return ok
+}
+
+// startCatchup makes conn catch up with the messages read returns, and
+// sends it the first of them.
+func (c *channel) startCatchup(conn *connection, read func(max int) []message) {
+	c.catchups[conn] = &catchup{read: read, progress: time.Now()}
+	c.catchUp()
+}
+
+// catchUp sends each subscriber that is catching up what fits in its send
+// buffer. Those with nothing left to read have caught up and get live
+// messages from now on. Those that take nothing for WriteWait are
+// unsubscribed, like slow subscribers of live messages.
+func (c *channel) catchUp() {
+	now := time.Now()
+	for conn, cu := range c.catchups {
+		for {
+			if len(cu.pending) == 0 {
+				free := cap(conn.send) - len(conn.send)
+				if free == 0 {
+					break
+				}
+				if cu.pending = cu.read(free); len(cu.pending) == 0 {
+					delete(c.catchups, conn)
+					break
+				}
+			}
+			sent := false
+			select {
+			case conn.send <- cu.pending[0]:
+				cu.pending = cu.pending[1:]
+				cu.progress = now
+				sent = true
+			default:
+			}
+			if !sent {
+				break
+			}
+		}
+		if c.catchingUp(conn) && now.Sub(cu.progress) > conn.cfg.WriteWait.Duration {
+			c.unsubscribe(conn)
+		}
+	}
+	if len(c.catchups) == 0 {
+		c.catchupTimer = nil
+	} else if c.catchupTimer == nil {
+		c.catchupTimer = time.NewTimer(catchupPeriod)
+	} else {
+		c.catchupTimer.Reset(catchupPeriod)
+	}
+}
+
+// catchupDue returns the channel of the next catch-up round, or nil.
+func (c *channel) catchupDue() <-chan time.Time {
+	if c.catchupTimer == nil {
+		return nil
+	}
+	return c.catchupTimer.C
+}
+
+// replay makes conn catch up with the logged messages from its requested
+// offset, less any that have expired or that its filter skips.
+func (c *channel) replay(conn *connection) {
+	r := &logReader{l: c.durable, from: conn.offset}
+	c.startCatchup(conn, func(max int) []message {
+		now := time.Now()
+		for {
+			msgs, err := r.read(max)
+			if err != nil {
+				log.Printf("durable log %s: %v", c.path, err)
+			}
+			if len(msgs) == 0 {
+				return nil
+			}
+			kept := msgs[:0]
+			for _, msg := range msgs {
+				if msg.expired(now) {
+					mark("expired", 1)
+					continue
+				}
+				if conn.filter.match(&parsedMessage{msg: msg}) {
+					kept = append(kept, msg)
+				}
+			}
+			if len(kept) > 0 {
+				return kept
+			}
+		}
+	})
+}
+
+// redeliver attaches an ack-mode subscriber to its cursor and makes it
+// catch up with the messages it hasn't acknowledged. Those its filter
+// skips are acknowledged for it.
+func (c *channel) redeliver(conn *connection) {
+	key := conn.cursor()
+	c.h.acks.attach(c.h.config(), c.path, key)
+	after := uint64(0)
+	c.startCatchup(conn, func(max int) []message {
+		for {
+			msgs := c.h.acks.since(c.path, key, after, max)
+			if len(msgs) == 0 {
+				return nil
+			}
+			after = msgs[len(msgs)-1].id
+			kept := msgs[:0]
+			for _, msg := range msgs {
+				if conn.filter.match(&parsedMessage{msg: msg}) {
+					kept = append(kept, msg)
+				} else {
+					c.h.acks.ack(c.path, key, msg.id)
+				}
+			}
+			if len(kept) > 0 {
+				return kept
+			}
+		}
+	})
+}
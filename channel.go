@@ -1,10 +1,41 @@
 package main
 
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
 type channel struct {
 	path        string
 	queue       queue
 	connections connections
 	h           *hub
+	policy      policy
+	history     []message
+	durable     *durableLog
+	groups      groups
+
+	// throttleTimer runs for the current throttle interval, if any, and
+	// held is the latest message waiting for it to end.
+	throttleTimer *time.Timer
+	held          *message
+
+	// catchups are the subscribers still catching up, and catchupTimer
+	// runs until the next round while there are any.
+	catchups     map[*connection]*catchup
+	catchupTimer *time.Timer
+
+	// subscribers is len(connections), readable by the hub.
+	subscribers atomic.Int64
+
+	// attached counts the connections yet to send their UNSUBSCRIBE,
+	// including slow consumers already unsubscribed by the channel, which
+	// may still send to the queue. subscribed counts the SUBSCRIBEs
+	// handled, and subscribes, owned by the hub, those sent.
+	attached   int
+	subscribed uint64
+	subscribes uint64
 }
 
 type connections map[*connection]interface {
@@ -13,49 +44,293 @@ type connections map[*connection]interface {
 func (c *channel) run() {
 	incr("channels", 1)
 	defer c.stop()
-	for cmd := range c.queue {
-		switch cmd.cmd {
-		case SUBSCRIBE:
-			c.subscribe(cmd.conn)
-		case UNSUBSCRIBE:
-			c.unsubscribe(cmd.conn)
-			if len(c.connections) == 0 {
+	c.load()
+	for {
+		select {
+		case cmd := <-c.queue:
+			c.handle(cmd)
+			if cmd.cmd == UNSUBSCRIBE && c.attached == 0 && c.deregister() {
 				return
 			}
-		case PUBLISH:
-			c.publish(cmd.text)
-		default:
-			break
+		case <-c.throttled():
+			c.release()
+		case <-c.catchupDue():
+			c.catchUp()
+		}
+	}
+}
+
+func (c *channel) handle(cmd command) {
+	switch cmd.cmd {
+	case SUBSCRIBE:
+		c.subscribed++
+		c.attached++
+		c.subscribe(cmd.conn)
+	case UNSUBSCRIBE:
+		c.attached--
+		c.unsubscribe(cmd.conn)
+	case PUBLISH:
+		n := c.publish(cmd.message)
+		if cmd.reply != nil {
+			cmd.reply <- n
+		}
+	case PRESENCE:
+		cmd.presence <- c.presence()
+	default:
+		break
+	}
+}
+
+// deregister asks the hub to forget the channel, handling commands sent
+// meanwhile, and reports whether it did. It doesn't if a subscriber is on
+// its way; otherwise nothing but the hub's earlier sends, still queued,
+// can reach the queue afterwards, so it can be closed.
+func (c *channel) deregister() bool {
+	removed := make(chan bool, 1)
+	hq := c.h.queue
+	remove := command{cmd: REMOVE, path: c.path, channel: c, subscribed: c.subscribed, removed: removed}
+	for {
+		select {
+		case hq <- remove:
+			hq = nil
+		case ok := <-removed:
+			return ok
+		case cmd := <-c.queue:
+			c.handle(cmd)
 		}
 	}
 }
 
 func (c *channel) stop() {
 	close(c.queue)
-	c.h.queue <- command{cmd: REMOVE, path: c.path}
+	// Nobody is left to receive a held message, but keep it.
+	if c.throttleTimer != nil {
+		c.throttleTimer.Stop()
+	}
+	if c.catchupTimer != nil {
+		c.catchupTimer.Stop()
+	}
+	if c.held != nil {
+		c.persist(*c.held)
+	}
+	// Answer any publishers still waiting on a reply, and keep their
+	// messages, but not requests, which need a responder.
+	for cmd := range c.queue {
+		if cmd.cmd == PUBLISH && cmd.replyTo == "" {
+			if len(cmd.text) == 0 {
+				c.persist(cmd.message)
+			} else if !c.h.dedups.duplicate(c.h.config(), c.path, cmd.message) {
+				if msg, ok := c.policy.filters.apply(cmd.message); ok {
+					c.persist(msg)
+				}
+			}
+		}
+		if cmd.reply != nil {
+			cmd.reply <- 0
+		}
+		if cmd.presence != nil {
+			cmd.presence <- presence{Path: c.path, Members: []string{}}
+		}
+	}
+	if c.durable != nil {
+		c.h.logs.release(c.durable)
+	}
 	decr("channels", 1)
 }
 
+// load opens a durable channel's log, once messages appended while the
+// path had no channel are in it, and rebuilds the history from it.
+func (c *channel) load() {
+	if !c.policy.durable {
+		return
+	}
+	c.h.logs.flush(c.path)
+	l, err := c.h.logs.open(c.path)
+	if err != nil {
+		log.Printf("durable log %s: %v", c.path, err)
+		return
+	}
+	c.durable = l
+	if c.policy.history > 0 {
+		c.history = l.tail(c.policy.history)
+	}
+}
+
 func (c *channel) subscribe(conn *connection) {
-	c.connections[conn] = nil
+	c.connections[conn] = conn.member
+	c.subscribers.Store(int64(len(c.connections)))
+	c.announce("join", conn)
+	if conn.group != "" {
+		// Group members share messages from now on; they don't get the
+		// history each.
+		c.join(conn)
+		return
+	}
+	if conn.replay && c.durable != nil {
+		c.replay(conn)
+		return
+	}
+	if conn.ack {
+		c.redeliver(conn)
+		return
+	}
+	// The retained message comes first; older retained messages in the
+	// history are superseded by it. Without one, as after a restart, those
+	// logged in the history are sent in place.
+	retained, hasRetained := c.h.retained.get(c.path)
+	if hasRetained && conn.filter.match(&parsedMessage{msg: retained}) {
+		select {
+		case conn.send <- retained:
+		default:
+		}
+	}
+	c.prune()
+	for _, msg := range c.history {
+		if msg.retain && hasRetained || !conn.filter.match(&parsedMessage{msg: msg}) {
+			continue
+		}
+		select {
+		case conn.send <- msg:
+		default:
+		}
+	}
 }
 
 func (c *channel) unsubscribe(conn *connection) {
 	if _, ok := c.connections[conn]; ok {
 		close(conn.send)
 		delete(c.connections, conn)
+		delete(c.catchups, conn)
+		c.subscribers.Store(int64(len(c.connections)))
+		c.announce("leave", conn)
+		if conn.ack {
+			c.h.acks.detach(c.path, conn.cursor())
+		}
+		if conn.group != "" {
+			c.leave(conn)
+		}
 	}
 }
 
-func (c *channel) publish(text []byte) {
-	if len(text) == 0 {
-		return
+// dropped is the number reached by a message that was expired, a
+// duplicate or dropped by a filter, rather than sent to no one.
+const dropped = -1
+
+// publish sends msg to every subscriber and returns the number reached,
+// or dropped.
+func (c *channel) publish(msg message) int {
+	if len(msg.text) == 0 {
+		c.persist(msg)
+		return 0
+	}
+	now := time.Now()
+	if msg.expired(now) {
+		mark("expired", 1)
+		return dropped
+	}
+	if c.h.dedups.duplicate(c.h.config(), c.path, msg) {
+		return dropped
+	}
+	msg, ok := c.policy.filters.apply(msg)
+	if !ok {
+		mark("filterdrops", 1)
+		return dropped
+	}
+	if c.policy.throttle > 0 {
+		return c.throttle(msg)
+	}
+	return c.deliver(msg)
+}
+
+// deliver persists, remembers and broadcasts a published message.
+func (c *channel) deliver(msg message) int {
+	msg = c.persist(msg)
+	c.remember(msg)
+	return c.broadcast(msg, true, nil)
+}
+
+// persist keeps msg beyond this delivery: in the channel's durable log,
+// if it has one, as the retained message if flagged, and for ack-mode
+// subscribers. An empty retained message clears the path's instead. It
+// returns msg with its offset and ID.
+func (c *channel) persist(msg message) message {
+	if len(msg.text) == 0 {
+		if msg.retain {
+			c.h.retained.clear(c.path)
+		}
+		return msg
+	}
+	if c.durable != nil {
+		if offset, err := c.durable.append(msg); err != nil {
+			log.Printf("durable log %s: %v", c.path, err)
+		} else {
+			msg.offset = offset
+		}
+	}
+	cfg := c.h.config()
+	if msg.retain {
+		c.h.retained.set(c.path, msg, cfg.MaxRetained)
+	}
+	return c.h.acks.record(cfg, c.path, msg)
+}
+
+// broadcast sends msg to every subscriber but except, if given, applying
+// the slow-consumer policy, and returns the number reached. If filtered is
+// set, subscriber filters apply and each consumer group gets one copy.
+func (c *channel) broadcast(msg message, filtered bool, except *connection) int {
+	n := 0
+	pm := &parsedMessage{msg: msg}
+	if filtered {
+		n = c.dispatch(msg, pm)
 	}
 	for conn := range c.connections {
+		if conn == except || filtered && (conn.group != "" || !conn.filter.match(pm) || c.catchingUp(conn)) {
+			continue
+		}
+		if conn.conflater != nil && c.policy.slowConsumer == slowConflate {
+			if conn.conflater.offer(conn, c.policy.conflationKey(pm), msg, c.h.config().ConflateMaxKeys) {
+				n++
+			} else {
+				c.unsubscribe(conn)
+			}
+			continue
+		}
 		select {
-		case conn.send <- text:
+		case conn.send <- msg:
+			n++
 		default:
+			if c.policy.slowConsumer == slowDrop {
+				mark("slowdrops", 1)
+				continue
+			}
 			c.unsubscribe(conn)
 		}
 	}
+	return n
+}
+
+// remember keeps msg in the channel's history, if it has one.
+func (c *channel) remember(msg message) {
+	if c.policy.history == 0 {
+		return
+	}
+	c.prune()
+	if len(c.history) == c.policy.history {
+		c.history = append(c.history[:0], c.history[1:]...)
+	}
+	c.history = append(c.history, msg)
+}
+
+// prune drops expired messages from the history.
+func (c *channel) prune() {
+	now := time.Now()
+	kept := c.history[:0]
+	for _, msg := range c.history {
+		if msg.expired(now) {
+			mark("expired", 1)
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	c.history = kept
 }
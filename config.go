@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Poll the config file for changes with this period.
+const configPollPeriod = 5 * time.Second
+
+// config holds the settings shared by the handlers, hub and channels. It
+// is loaded from defaults, then an optional JSON file, then command line
+// flags. A config is never modified once in use; reloading replaces it.
+type config struct {
+	// File is the JSON config file, if any.
+	File string `json:"-"`
+
+	// Addr is the http service address: a TCP address or an absolute
+	// path for a UNIX socket. Not reloadable.
+	Addr string
+
+	// Listeners replace Addr with several addresses, each allowing its
+	// own operations. Not reloadable.
+	Listeners listeners
+
+	// MetricsPort is the local TCP port of the metrics service. Not
+	// reloadable.
+	MetricsPort string
+
+	// Log is the absolute path of the log file. Not reloadable.
+	Log string
+
+	// Origins are checked against websocket Origin headers. Empty allows
+	// any origin.
+	Origins origins
+
+	// RequireOrigin rejects websockets without an Origin header.
+	RequireOrigin bool
+
+	// CORS lets browsers on the allowed Origins POST from other origins.
+	CORS bool
+
+	// PathLenMin and PathLenMax bound path length in Unicode characters.
+	PathLenMin int
+	PathLenMax int
+
+	// MaxMessageSize is the largest message accepted from any transport.
+	MaxMessageSize int64
+
+	// Rules set per-path policy, overriding the settings below for
+	// matching paths. See rule.
+	Rules rules
+
+	// PublishLimit and ConnectLimit rate limit publishing (POST and
+	// websocket messages) and websocket connections.
+	PublishLimit rateLimit
+	ConnectLimit rateLimit
+
+	// MaxConnections, MaxConnectionsPerIP and MaxSubscribers cap open
+	// websockets in total, per remote IP and per path. Zero is unlimited.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	MaxSubscribers      int
+
+	// IPHeader names a header holding the client IP, set by a trusted
+	// reverse proxy. Empty uses the connection's remote address.
+	IPHeader string
+
+	// IdentityHeader names a header holding the authenticated identity,
+	// set by a trusted reverse proxy.
+	IdentityHeader string
+
+	// Node identifies this server in webhook events. It defaults to the
+	// host name.
+	Node string
+
+	// Webhooks are notified when channels are created and removed.
+	Webhooks webhooks
+
+	// Durability configures the logs of paths with durable rules. Not
+	// reloadable.
+	Durability durability
+
+	// AckRetention is how long the cursor of a disconnected ack-mode
+	// subscriber, with its unacknowledged messages, is kept for it to
+	// reconnect. AckMaxPending caps each cursor's unacknowledged messages;
+	// the oldest are dropped.
+	AckRetention  duration
+	AckMaxPending int
+
+	// ScheduleFile keeps messages scheduled with Deliver-At or Delay
+	// across restarts. Empty keeps them only in memory. Not reloadable.
+	ScheduleFile string
+
+	// MaxDelay is how far ahead a message can be scheduled, and
+	// MaxScheduled caps the number pending.
+	MaxDelay     duration
+	MaxScheduled int
+
+	// MaxRetained caps the number of paths with a retained message.
+	MaxRetained int
+
+	// DedupWindow is how long a path remembers idempotency keys to
+	// suppress duplicates, and DedupMaxKeys caps the keys it remembers.
+	DedupWindow  duration
+	DedupMaxKeys int
+
+	// ConflateMaxKeys caps the keys a conflating subscriber holds
+	// messages for; past it, the subscriber is disconnected.
+	ConflateMaxKeys int
+
+	// ReplyTimeout is how long a request waits for a reply unless it
+	// gives a timeout, which can't be over MaxReplyTimeout.
+	ReplyTimeout    duration
+	MaxReplyTimeout duration
+
+	// WriteWait is the time allowed to write a message to the peer.
+	// PongWait is the time allowed to read the next pong from the peer;
+	// pings are sent every 9/10 of it.
+	WriteWait duration
+	PongWait  duration
+
+	// ReadBufferSize and WriteBufferSize size websocket I/O buffers. Not
+	// reloadable. SendBufferSize is the number of messages queued for
+	// each subscriber before it is considered too slow.
+	ReadBufferSize  int
+	WriteBufferSize int
+	SendBufferSize  int
+}
+
+func newConfig() *config {
+	node, _ := os.Hostname()
+	return &config{
+		Node:            node,
+		Addr:            "127.0.0.1:8081",
+		MetricsPort:     "8082",
+		PathLenMin:      pathLenMin,
+		PathLenMax:      pathLenMax,
+		MaxMessageSize:  maxMessageSize,
+		WriteWait:       duration{writeWait},
+		PongWait:        duration{pongWait},
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		SendBufferSize:  256,
+		AckRetention:    duration{5 * time.Minute},
+		AckMaxPending:   1000,
+		ReplyTimeout:    duration{10 * time.Second},
+		MaxReplyTimeout: duration{time.Minute},
+		MaxDelay:        duration{24 * time.Hour},
+		MaxScheduled:    10000,
+		MaxRetained:     10000,
+		DedupWindow:     duration{5 * time.Minute},
+		DedupMaxKeys:    10000,
+		ConflateMaxKeys: 1000,
+		Durability: durability{
+			Fsync:         fsyncInterval,
+			FsyncInterval: duration{time.Second},
+			SegmentBytes:  64 << 20,
+		},
+	}
+}
+
+// flags binds command line flags to c. Call it after c is loaded so the
+// flags default to the loaded values.
+func (c *config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.File, "config", c.File, "JSON config file, reloaded on SIGHUP or change")
+	fs.StringVar(&c.MetricsPort, "mport", c.MetricsPort, "metrics service port")
+	fs.StringVar(&c.Addr, "addr", c.Addr, "http service address (TCP address or absolute path for UNIX socket)")
+	fs.Var(&c.Listeners, "listen", "listener allowing only some operations, as addr=op[,op] with ops subscribe, publish, admin (repeatable, replaces -addr)")
+	fs.Var(&c.Origins, "origin", "websocket server checks Origin headers against these scheme://host[:port], host may start with *. (comma-separated, repeatable)")
+	fs.BoolVar(&c.RequireOrigin, "requireorigin", c.RequireOrigin, "reject websockets without an Origin header")
+	fs.BoolVar(&c.CORS, "cors", c.CORS, "answer CORS preflights and allow POSTs from the -origin list")
+	fs.StringVar(&c.Log, "log", c.Log, "Log file (absolute path)")
+	fs.Int64Var(&c.MaxMessageSize, "maxmsg", c.MaxMessageSize, "maximum message size in bytes")
+	fs.Var(&c.Rules, "maxmsgpath", "maximum message size for paths matching a pattern, as pattern=bytes (repeatable, takes precedence over config file Rules)")
+	fs.Var(&c.PublishLimit, "publimit", "publish rate limits per second, as ip=rate[:burst],identity=rate[:burst],path=rate[:burst]")
+	fs.Var(&c.ConnectLimit, "connlimit", "websocket connect rate limits per second, as ip=rate[:burst],identity=rate[:burst],path=rate[:burst]")
+	fs.IntVar(&c.MaxConnections, "maxconns", c.MaxConnections, "maximum open websockets (0 is unlimited)")
+	fs.IntVar(&c.MaxConnectionsPerIP, "maxconnsip", c.MaxConnectionsPerIP, "maximum open websockets per remote IP (0 is unlimited)")
+	fs.IntVar(&c.MaxSubscribers, "maxsubs", c.MaxSubscribers, "maximum subscribers per path (0 is unlimited)")
+	fs.StringVar(&c.IPHeader, "ipheader", c.IPHeader, "header holding the client IP set by a trusted reverse proxy (e.g. X-Real-IP)")
+	fs.StringVar(&c.IdentityHeader, "identityheader", c.IdentityHeader, "header holding the authenticated identity set by a trusted reverse proxy")
+}
+
+// loadConfig builds a config from defaults, then the JSON file (if any),
+// then args, and validates it.
+func loadConfig(file string, args []string) (*config, error) {
+	c := newConfig()
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	// Rules from flags come before the file's so that they win.
+	fileRules := c.Rules
+	c.Rules = nil
+	fs := flag.NewFlagSet("pinghub", flag.ContinueOnError)
+	c.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	c.Rules = append(c.Rules, fileRules...)
+	c.File = file
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// validate reports every problem with c in one error.
+func (c *config) validate() error {
+	var errs []error
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf("config: "+format, a...))
+	}
+	if c.Addr == "" && len(c.Listeners) == 0 {
+		fail("Addr or Listeners is required")
+	}
+	c.Listeners.validate(fail)
+	if _, err := strconv.ParseUint(c.MetricsPort, 10, 16); err != nil {
+		fail("MetricsPort %q is not a port number", c.MetricsPort)
+	}
+	if c.Log != "" && !strings.HasPrefix(c.Log, "/") {
+		fail("Log %q must be an absolute path", c.Log)
+	}
+	c.Origins.validate(fail, "Origins")
+	if c.PathLenMin < 1 || c.PathLenMax < c.PathLenMin {
+		fail("PathLenMin (%d) and PathLenMax (%d) must satisfy 1 <= min <= max", c.PathLenMin, c.PathLenMax)
+	}
+	if c.MaxMessageSize < 1 {
+		fail("MaxMessageSize must be positive")
+	}
+	c.Rules.validate(fail)
+	c.Webhooks.validate(fail)
+	c.Durability.validate(fail)
+	for _, r := range c.Rules {
+		if r.Durable && c.Durability.Dir == "" {
+			fail("Rules %q: Durable requires Durability.Dir", r.Pattern)
+		}
+	}
+	for _, rl := range []struct {
+		name  string
+		limit rateLimit
+	}{{"PublishLimit", c.PublishLimit}, {"ConnectLimit", c.ConnectLimit}} {
+		for _, spec := range []rateSpec{rl.limit.IP, rl.limit.Identity, rl.limit.Path} {
+			if spec.Rate < 0 || spec.Burst < 0 {
+				fail("%s rates and bursts must not be negative", rl.name)
+				break
+			}
+		}
+	}
+	if c.MaxConnections < 0 || c.MaxConnectionsPerIP < 0 || c.MaxSubscribers < 0 {
+		fail("connection limits must not be negative")
+	}
+	if c.WriteWait.Duration <= 0 || c.PongWait.Duration <= 0 {
+		fail("WriteWait and PongWait must be positive")
+	}
+	if c.AckRetention.Duration <= 0 || c.AckMaxPending < 1 {
+		fail("AckRetention and AckMaxPending must be positive")
+	}
+	if c.ScheduleFile != "" && !strings.HasPrefix(c.ScheduleFile, "/") {
+		fail("ScheduleFile %q must be an absolute path", c.ScheduleFile)
+	}
+	if c.MaxDelay.Duration <= 0 || c.MaxScheduled < 1 || c.MaxRetained < 1 {
+		fail("MaxDelay, MaxScheduled and MaxRetained must be positive")
+	}
+	if c.DedupWindow.Duration <= 0 || c.DedupMaxKeys < 1 {
+		fail("DedupWindow and DedupMaxKeys must be positive")
+	}
+	if c.ConflateMaxKeys < 1 {
+		fail("ConflateMaxKeys must be positive")
+	}
+	if c.ReplyTimeout.Duration <= 0 || c.MaxReplyTimeout.Duration < c.ReplyTimeout.Duration {
+		fail("ReplyTimeout must be positive and at most MaxReplyTimeout")
+	}
+	if c.ReadBufferSize < 1 || c.WriteBufferSize < 1 || c.SendBufferSize < 1 {
+		fail("buffer sizes must be positive")
+	}
+	return errors.Join(errs...)
+}
+
+// reloadable returns next with the settings that can't change at runtime
+// copied from c, logging any that were changed.
+func (c *config) reloadable(next *config) *config {
+	fixed := *next
+	if next.listeners().String() != c.listeners().String() ||
+		next.MetricsPort != c.MetricsPort || next.Log != c.Log ||
+		next.ReadBufferSize != c.ReadBufferSize || next.WriteBufferSize != c.WriteBufferSize ||
+		next.Durability != c.Durability || next.ScheduleFile != c.ScheduleFile {
+		log.Printf("config: Addr, Listeners, MetricsPort, Log, Durability, ScheduleFile and websocket buffer sizes require a restart")
+	}
+	fixed.Addr = c.Addr
+	fixed.Listeners = c.Listeners
+	fixed.MetricsPort = c.MetricsPort
+	fixed.Log = c.Log
+	fixed.ReadBufferSize = c.ReadBufferSize
+	fixed.WriteBufferSize = c.WriteBufferSize
+	fixed.Durability = c.Durability
+	fixed.ScheduleFile = c.ScheduleFile
+	return &fixed
+}
+
+// pingPeriod is how often pings are sent to the peer. It must be less
+// than PongWait.
+func (c *config) pingPeriod() time.Duration {
+	return (c.PongWait.Duration * 9) / 10
+}
+
+// messageLimit returns the maximum message size for path.
+func (c *config) messageLimit(path string) int64 {
+	return c.policy(path).maxMessageSize
+}
+
+// duration is a time.Duration written in config files as a string such
+// as "10s" or as a number of seconds.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		dur, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		d.Duration = dur
+		return nil
+	}
+	var secs float64
+	if err := json.Unmarshal(b, &secs); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\" or a number of seconds")
+	}
+	d.Duration = time.Duration(secs * float64(time.Second))
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
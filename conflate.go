@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// conflater holds the messages a slow subscriber on a conflating path
+// hasn't been sent yet, keeping only the newest message per conflation
+// key. Once it holds any, the channel gives it every new message so that
+// order is kept; the writer takes them when the send buffer is empty.
+type conflater struct {
+	sync.Mutex
+	pending map[string]message
+	order   []string // keys in the order first pending
+	wake    chan struct{}
+}
+
+func newConflater() *conflater {
+	return &conflater{
+		pending: make(map[string]message),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// offer sends msg to conn, or holds it under key if conn's send buffer
+// is full or it already holds messages. It returns false, holding nothing,
+// if that would take more than max keys.
+func (cf *conflater) offer(conn *connection, key string, msg message, max int) bool {
+	cf.Lock()
+	defer cf.Unlock()
+	if len(cf.order) == 0 {
+		select {
+		case conn.send <- msg:
+			return true
+		default:
+		}
+	}
+	if _, ok := cf.pending[key]; ok {
+		mark("conflated", 1)
+	} else if len(cf.order) == max {
+		return false
+	} else {
+		cf.order = append(cf.order, key)
+	}
+	cf.pending[key] = msg
+	select {
+	case cf.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// take returns the held messages in order and empties the conflater.
+func (cf *conflater) take() []message {
+	cf.Lock()
+	defer cf.Unlock()
+	msgs := make([]message, 0, len(cf.order))
+	for _, key := range cf.order {
+		msgs = append(msgs, cf.pending[key])
+	}
+	clear(cf.pending)
+	cf.order = cf.order[:0]
+	return msgs
+}
+
+// conflationKey returns the key msg is conflated under: the JSON text of
+// the path's ConflateKey field, or "" to conflate every message.
+func (p policy) conflationKey(pm *parsedMessage) string {
+	if p.conflateKey == nil {
+		return ""
+	}
+	v, ok := lookup(pm.json(), p.conflateKey)
+	if !ok {
+		return ""
+	}
+	text, _ := json.Marshal(v)
+	return string(text)
+}
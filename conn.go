@@ -5,6 +5,7 @@ import (
 	"time"
 )
 
+// Defaults for the corresponding config settings.
 const (
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
@@ -12,30 +13,60 @@ const (
 	// Time allowed to read the next pong message from the peer.
 	pongWait = 30 * time.Second
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
 	// Maximum message size allowed from peer.
 	maxMessageSize = 65536 // 64KB (64 * 1024)
 )
 
 type connection struct {
-	control chan *channel
-	channel *channel
-	send    chan []byte
-	ws      *websocket.Conn
-	h       *hub
-	path    string
+	control  chan *channel
+	channel  *channel
+	send     chan message
+	ws       *websocket.Conn
+	h        *hub
+	path     string
+	ip       string
+	identity string
+	member   string
+	filter   *subscriberFilter
+	cfg      *config
+
+	// replay asks a durable channel for its logged messages from offset.
+	replay bool
+	offset uint64
+
+	// envelope sends messages as JSON envelopes with their metadata.
+	envelope bool
+
+	// ack asks for at-least-once delivery: messages carry IDs, the client
+	// acknowledges them, and unacknowledged ones are redelivered when the
+	// same subscriber reconnects.
+	ack        bool
+	subscriber string
+
+	// group names the consumer group sharing the channel's messages with
+	// this connection, if any.
+	group string
+
+	// conflater holds messages for a slow subscriber on a conflating path.
+	conflater *conflater
 }
 
-func newConnection(ws *websocket.Conn, h *hub, path string) *connection {
-	return &connection{
-		control: make(chan *channel, 1),
-		send:    make(chan []byte, 256),
-		ws:      ws,
-		h:       h,
-		path:    path,
+func newConnection(ws *websocket.Conn, h *hub, path, ip, identity string) *connection {
+	cfg := h.config()
+	c := &connection{
+		control:  make(chan *channel, 1),
+		send:     make(chan message, cfg.SendBufferSize),
+		ws:       ws,
+		h:        h,
+		path:     path,
+		ip:       ip,
+		identity: identity,
+		cfg:      cfg,
+	}
+	if cfg.policy(path).slowConsumer == slowConflate {
+		c.conflater = newConflater()
 	}
+	return c
 }
 
 func (c *connection) run() {
@@ -52,43 +83,77 @@ func (c *connection) run() {
 }
 
 func (c *connection) reader() {
-	c.ws.SetReadLimit(maxMessageSize)
+	pongWait := c.cfg.PongWait.Duration
+	c.ws.SetReadLimit(c.channel.policy.maxMessageSize)
 	c.ws.SetReadDeadline(time.Now().Add(pongWait))
 	c.ws.SetPongHandler(func(s string) error { c.ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 
 	for {
-		_, message, err := c.ws.ReadMessage()
+		mt, text, err := c.ws.ReadMessage()
 		if err != nil {
 			break
 		}
+		if c.ack && mt == websocket.TextMessage {
+			if id, ok := parseAck(text); ok {
+				c.h.acks.ack(c.path, c.cursor(), id)
+				continue
+			}
+		}
+		msg := message{text: text, binary: mt == websocket.BinaryMessage, sender: c.sender()}
 		// empty message: echo only, no broadcast
-		if len(message) == 0 {
-			c.send <- []byte{}
+		if len(text) == 0 {
+			c.send <- msg
 			continue
 		}
-		c.channel.queue <- command{cmd: PUBLISH, path: c.path, text: message}
+		if c.envelope && !msg.binary {
+			if msg, err = openEnvelope(text, time.Now()); err != nil {
+				c.closeWith(websocket.CloseUnsupportedData, "expected an envelope: "+err.Error())
+				break
+			}
+			msg.sender = c.sender()
+		}
+		if !c.channel.policy.clientPublish {
+			c.closeWith(websocket.ClosePolicyViolation, "publishing is not allowed on this path")
+			break
+		}
+		if !c.h.allowPublish(c.channel.policy, c.ip, c.identity, c.path) {
+			mark("publimits", 1)
+			c.closeWith(websocket.CloseTryAgainLater, "rate limit exceeded")
+			break
+		}
+		c.channel.queue <- command{cmd: PUBLISH, path: c.path, message: msg}
 		mark("websocketmsgs", 1)
 	}
 	c.ws.Close()
 }
 
 func (c *connection) writer() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.cfg.pingPeriod())
 	defer func() {
 		ticker.Stop()
 		c.ws.Close()
 	}()
+	var wake chan struct{}
+	if c.conflater != nil {
+		wake = c.conflater.wake
+	}
 	for {
 		select {
-		case message, ok := <-c.send:
+		case msg, ok := <-c.send:
 			if !ok {
 				c.write(websocket.CloseMessage, []byte{})
 				return
 			}
-			if err := c.write(websocket.TextMessage, message); err != nil {
+			if err := c.writeMessage(msg); err != nil {
+				return
+			}
+			if err := c.flushConflated(); err != nil {
+				return
+			}
+		case <-wake:
+			if err := c.flushConflated(); err != nil {
 				return
 			}
-			mark("sends", 1)
 		case <-ticker.C:
 			if err := c.write(websocket.PingMessage, []byte{}); err != nil {
 				return
@@ -97,7 +162,62 @@ func (c *connection) writer() {
 	}
 }
 
+// writeMessage writes msg unless it has expired.
+func (c *connection) writeMessage(msg message) error {
+	if msg.expired(time.Now()) {
+		mark("expired", 1)
+		return nil
+	}
+	mt, payload := websocket.TextMessage, msg.text
+	// Requests need an envelope to carry their reply path.
+	if c.envelope || msg.replyTo != "" {
+		payload = msg.envelope()
+	} else if msg.binary {
+		mt = websocket.BinaryMessage
+	}
+	if err := c.write(mt, payload); err != nil {
+		return err
+	}
+	mark("sends", 1)
+	return nil
+}
+
+// flushConflated writes the messages held by the conflater once the send
+// buffer has drained, so they follow everything sent before them.
+func (c *connection) flushConflated() error {
+	if c.conflater == nil || len(c.send) > 0 {
+		return nil
+	}
+	for _, msg := range c.conflater.take() {
+		if err := c.writeMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cursor identifies the connection's ack-mode cursor.
+func (c *connection) cursor() cursorKey {
+	return cursorKey{identity: c.identity, subscriber: c.subscriber}
+}
+
+// sender identifies the connection as a publisher.
+func (c *connection) sender() string {
+	if c.identity != "" {
+		return c.identity
+	}
+	return c.ip
+}
+
+// closeWith sends a close frame with code and reason. It is safe to call
+// concurrently with the writer.
+func (c *connection) closeWith(code int, reason string) {
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(c.cfg.WriteWait.Duration))
+}
+
 func (c *connection) write(mt int, payload []byte) error {
-	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	c.ws.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait.Duration))
 	return c.ws.WriteMessage(mt, payload)
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// connCounter tracks open websockets so that connection caps can be
+// checked before a request is upgraded.
+type connCounter struct {
+	sync.Mutex
+	total int
+	ips   map[string]int
+	paths map[string]int
+}
+
+func newConnCounter() *connCounter {
+	return &connCounter{
+		ips:   make(map[string]int),
+		paths: make(map[string]int),
+	}
+}
+
+// acquire counts a new connection from ip to path. If a cap would be
+// exceeded it returns false with the HTTP status and reason to send.
+func (cc *connCounter) acquire(cfg *config, ip, path string) (bool, int, string) {
+	cc.Lock()
+	defer cc.Unlock()
+	if cfg.MaxConnections > 0 && cc.total >= cfg.MaxConnections {
+		return false, http.StatusServiceUnavailable, "Server connection limit reached."
+	}
+	if cfg.MaxConnectionsPerIP > 0 && cc.ips[ip] >= cfg.MaxConnectionsPerIP {
+		return false, http.StatusTooManyRequests, "Too many connections from this address."
+	}
+	if max := cfg.policy(path).maxSubscribers; max > 0 && cc.paths[path] >= max {
+		return false, http.StatusServiceUnavailable, "Channel subscriber limit reached."
+	}
+	cc.total++
+	cc.ips[ip]++
+	cc.paths[path]++
+	return true, http.StatusOK, ""
+}
+
+func (cc *connCounter) release(ip, path string) {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.total--
+	if cc.ips[ip]--; cc.ips[ip] <= 0 {
+		delete(cc.ips, ip)
+	}
+	if cc.paths[path]--; cc.paths[path] <= 0 {
+		delete(cc.paths, path)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Allow browsers to cache preflight results for this long (seconds).
+const corsMaxAge = 600
+
+// corsHandler answers CORS preflight requests for POST and DELETE.
+type corsHandler struct {
+	hub *hub
+}
+
+func (ch corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := ch.hub.config()
+	if !cfg.CORS || r.Header.Get("Origin") == "" {
+		w.Header().Set("Allow", "GET, POST, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !cfg.cors(w, r) {
+		return
+	}
+	if method := r.Header.Get("Access-Control-Request-Method"); method != "POST" && method != "DELETE" {
+		http.Error(w,
+			fmt.Sprintf("Error: forbidden. CORS method %q is not allowed.", method),
+			http.StatusForbidden)
+		return
+	}
+	h := w.Header()
+	h.Set("Access-Control-Allow-Methods", "POST, DELETE")
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	h.Set("Access-Control-Max-Age", fmt.Sprint(corsMaxAge))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cors sets the CORS response headers for a request from another origin
+// when CORS is enabled. It refuses the request and returns false if the
+// origin is not allowed for the path.
+func (c *config) cors(w http.ResponseWriter, r *http.Request) bool {
+	return c.corsPaths(w, r, []string{r.URL.Path})
+}
+
+// corsPaths is cors for a request that publishes to paths, such as the
+// targets of a multicast. The origin must be allowed for each of them.
+func (c *config) corsPaths(w http.ResponseWriter, r *http.Request, paths []string) bool {
+	origin := r.Header.Get("Origin")
+	if !c.CORS || origin == "" {
+		return true
+	}
+	w.Header().Add("Vary", "Origin")
+	for _, path := range paths {
+		if !c.policy(path).origins.allows(origin) {
+			c.rejectOrigin(r, origin)
+			http.Error(w,
+				fmt.Sprintf("Error: forbidden. Origin %q is not allowed.", origin),
+				http.StatusForbidden)
+			return false
+		}
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	return true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// countHandler answers subscriber count queries. HEAD /path?count sets
+// only the X-Subscribers header, GET /path?count also writes the count as
+// plain text and GET /?count&path=/a&path=/b writes a JSON object of
+// counts by path.
+type countHandler struct {
+	hub *hub
+}
+
+func (ch countHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := ch.hub.config()
+	if !validateRequest(cfg, w, r) {
+		return
+	}
+	paths, bulk := r.URL.Query()["path"]
+	if !bulk {
+		paths = []string{r.URL.Path}
+	}
+	for _, p := range paths {
+		if !validatePath(cfg, w, p) {
+			return
+		}
+	}
+	counts := ch.hub.count(paths)
+	if bulk {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(counts)
+		return
+	}
+	n := counts[r.URL.Path]
+	w.Header().Set("X-Subscribers", strconv.Itoa(n))
+	if r.Method == "HEAD" {
+		return
+	}
+	fmt.Fprintf(w, "%d\n", n)
+}
+
+// count asks the hub for the number of subscribers of each path.
+func (h *hub) count(paths []string) map[string]int {
+	reply := make(chan map[string]int, 1)
+	h.queue <- command{cmd: COUNT, paths: paths, counts: reply}
+	return <-reply
+}
+
+// hasQuery matches requests with the query parameter key.
+func hasQuery(key string) func(*http.Request, *mux.RouteMatch) bool {
+	return func(r *http.Request, rm *mux.RouteMatch) bool {
+		return r.URL.Query().Has(key)
+	}
+}
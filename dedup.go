@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyKeyMax bounds idempotency keys in bytes.
+const idempotencyKeyMax = 256
+
+// dedupStore keeps the recently published idempotency keys of each path,
+// whether or not it has a channel, so that a duplicate is neither
+// broadcast nor persisted.
+type dedupStore struct {
+	sync.Mutex
+	paths map[string]*dedup
+	swept time.Time
+}
+
+func newDedupStore() *dedupStore {
+	return &dedupStore{paths: make(map[string]*dedup)}
+}
+
+// duplicate reports whether msg repeats an idempotency key published to
+// path within DedupWindow, and remembers its key if not.
+func (s *dedupStore) duplicate(cfg *config, path string, msg message) bool {
+	if msg.key == "" {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	s.sweep(cfg, now)
+	d, ok := s.paths[path]
+	if !ok {
+		d = newDedup()
+		s.paths[path] = d
+	}
+	if d.duplicate(msg.key, now, cfg.DedupWindow.Duration, cfg.DedupMaxKeys) {
+		mark("dupes", 1)
+		return true
+	}
+	return false
+}
+
+// sweep forgets paths whose keys are all older than DedupWindow, at most
+// once a minute.
+func (s *dedupStore) sweep(cfg *config, now time.Time) {
+	if now.Sub(s.swept) < time.Minute {
+		return
+	}
+	s.swept = now
+	for path, d := range s.paths {
+		if newest := d.order[len(d.order)-1]; now.Sub(d.seen[newest]) > cfg.DedupWindow.Duration {
+			delete(s.paths, path)
+		}
+	}
+}
+
+// dedup is a path's set of recently published idempotency keys. Keys are
+// forgotten after the window, or oldest first past the cap.
+type dedup struct {
+	seen  map[string]time.Time
+	order []string // keys in the order seen
+}
+
+func newDedup() *dedup {
+	return &dedup{seen: make(map[string]time.Time)}
+}
+
+// duplicate reports whether key was seen within window, and remembers it
+// if not.
+func (d *dedup) duplicate(key string, now time.Time, window time.Duration, max int) bool {
+	for len(d.order) > 0 && (now.Sub(d.seen[d.order[0]]) > window || len(d.order) >= max) {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+	d.seen[key] = now
+	d.order = append(d.order, key)
+	return false
+}
+
+// idempotencyKey returns the Idempotency-Key header of a POST.
+func idempotencyKey(r *http.Request) (string, error) {
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > idempotencyKeyMax {
+		return "", fmt.Errorf("Idempotency-Key can be at most %d bytes", idempotencyKeyMax)
+	}
+	return key, nil
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fsync policies for durable channels.
+const (
+	fsyncAlways   = "always"   // sync after every message
+	fsyncInterval = "interval" // sync dirty logs every FsyncInterval (default)
+	fsyncNever    = "never"    // leave it to the OS
+)
+
+// durability configures the on-disk logs of durable channels. It is not
+// reloadable.
+type durability struct {
+	// Dir holds one directory of segment files per durable path.
+	Dir string
+
+	// Fsync is fsyncAlways, fsyncInterval or fsyncNever.
+	Fsync         string
+	FsyncInterval duration
+
+	// SegmentBytes is the size at which a new segment file is started.
+	SegmentBytes int64
+
+	// RetainBytes and RetainAge bound each path's log. When a segment is
+	// started, the oldest ones are deleted while the log is over
+	// RetainBytes or they were last written before RetainAge. Zero is
+	// unlimited.
+	RetainBytes int64
+	RetainAge   duration
+}
+
+func (d *durability) validate(fail func(format string, a ...interface{})) {
+	switch d.Fsync {
+	case fsyncAlways, fsyncInterval, fsyncNever:
+	default:
+		fail("Durability: Fsync %q must be %q, %q or %q", d.Fsync, fsyncAlways, fsyncInterval, fsyncNever)
+	}
+	if d.FsyncInterval.Duration <= 0 || d.SegmentBytes < 1 {
+		fail("Durability: FsyncInterval and SegmentBytes must be positive")
+	}
+	if d.RetainBytes < 0 || d.RetainAge.Duration < 0 {
+		fail("Durability: RetainBytes and RetainAge must not be negative")
+	}
+}
+
+// replayOffset parses the offset connect parameter, which asks a durable
+// channel to replay its log from that offset.
+func replayOffset(q url.Values) (bool, uint64, error) {
+	if !q.Has("offset") {
+		return false, 0, nil
+	}
+	offset, err := strconv.ParseUint(q.Get("offset"), 10, 64)
+	if err != nil {
+		return false, 0, fmt.Errorf("offset %q is not a log offset", q.Get("offset"))
+	}
+	return true, offset, nil
+}
+
+// logStore opens and keeps the logs of durable paths while they are in
+// use, and appends for paths with no channel.
+type logStore struct {
+	sync.Mutex
+	d    durability
+	logs map[string]*durableLog
+
+	// writers append messages for paths with no channel, one goroutine
+	// per path while it has any, so that the hub never waits on a disk.
+	wmu     sync.Mutex
+	writers map[string]*logWriter
+}
+
+// logWriter is the queue of messages waiting to be appended to a path's
+// log, and done is closed once it is empty.
+type logWriter struct {
+	msgs []message
+	done chan struct{}
+}
+
+func newLogStore(d durability) *logStore {
+	s := &logStore{
+		d:       d,
+		logs:    make(map[string]*durableLog),
+		writers: make(map[string]*logWriter),
+	}
+	if d.Fsync == fsyncInterval {
+		go s.syncLoop()
+	}
+	return s
+}
+
+// open returns the log for path, opening or creating it if needed. Each
+// open must be matched by a release.
+func (s *logStore) open(path string) (*durableLog, error) {
+	if s == nil || s.d.Dir == "" {
+		return nil, errors.New("durability is not configured (Durability.Dir)")
+	}
+	s.Lock()
+	defer s.Unlock()
+	if l, ok := s.logs[path]; ok {
+		l.refs++
+		return l, nil
+	}
+	sum := sha256.Sum256([]byte(path))
+	l, err := openLog(filepath.Join(s.d.Dir, hex.EncodeToString(sum[:16])), path, s.d)
+	if err != nil {
+		return nil, err
+	}
+	l.path = path
+	l.refs = 1
+	s.logs[path] = l
+	return l, nil
+}
+
+// release gives up a reference to l, closing it if it was the last.
+func (s *logStore) release(l *durableLog) {
+	s.Lock()
+	defer s.Unlock()
+	if l.refs--; l.refs > 0 {
+		return
+	}
+	delete(s.logs, l.path)
+	l.close()
+}
+
+// appendLater queues msg to be appended to path's log without waiting.
+func (s *logStore) appendLater(path string, msg message) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	w, ok := s.writers[path]
+	if !ok {
+		w = &logWriter{done: make(chan struct{})}
+		s.writers[path] = w
+		go s.write(path, w)
+	}
+	w.msgs = append(w.msgs, msg)
+}
+
+// write appends w's messages to path's log until none are left.
+func (s *logStore) write(path string, w *logWriter) {
+	for {
+		s.wmu.Lock()
+		msgs := w.msgs
+		w.msgs = nil
+		if len(msgs) == 0 {
+			delete(s.writers, path)
+			close(w.done)
+			s.wmu.Unlock()
+			return
+		}
+		s.wmu.Unlock()
+		l, err := s.open(path)
+		if err != nil {
+			log.Printf("durable log %s: %v", path, err)
+			continue
+		}
+		for _, msg := range msgs {
+			if _, err := l.append(msg); err != nil {
+				log.Printf("durable log %s: %v", path, err)
+			}
+		}
+		s.release(l)
+	}
+}
+
+// flush waits until messages queued for path have been appended.
+func (s *logStore) flush(path string) {
+	s.wmu.Lock()
+	w := s.writers[path]
+	s.wmu.Unlock()
+	if w != nil {
+		<-w.done
+	}
+}
+
+func (s *logStore) syncLoop() {
+	ticker := time.NewTicker(s.d.FsyncInterval.Duration)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.Lock()
+		logs := make([]*durableLog, 0, len(s.logs))
+		for _, l := range s.logs {
+			logs = append(logs, l)
+		}
+		s.Unlock()
+		for _, l := range logs {
+			l.sync()
+		}
+	}
+}
+
+// durableLog is an append-only log of one path's messages, stored as
+// segment files named by the offset of their first message. Offsets
+// start at 1.
+//
+// Each record is a header (offset, expiry in unix nanoseconds or 0, flags,
+// key length, text length), the idempotency key, the message text and a
+// CRC-32 of all of them.
+type durableLog struct {
+	sync.Mutex
+	path     string
+	refs     int // guarded by the logStore
+	dir      string
+	d        durability
+	segments []segment
+	active   *os.File
+	next     uint64
+	dirty    bool
+}
+
+type segment struct {
+	base uint64
+	size int64
+}
+
+const (
+	recordHeader = 8 + 8 + 1 + 2 + 4
+	recordCRC    = 4
+
+	flagBinary = 1
+	flagRetain = 2
+)
+
+func segmentName(base uint64) string {
+	return fmt.Sprintf("%020d.seg", base)
+}
+
+// openLog opens the log in dir, creating it if needed. A torn record at
+// the end of the last segment, left by a crash, is truncated.
+func openLog(dir, path string, d durability) (*durableLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// Record the path for operators; the directory name is a hash.
+	if err := os.WriteFile(filepath.Join(dir, "PATH"), []byte(path+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	l := &durableLog{dir: dir, d: d, next: 1}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		var base uint64
+		if _, err := fmt.Sscanf(e.Name(), "%020d.seg", &base); err != nil || !strings.HasSuffix(e.Name(), ".seg") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		l.segments = append(l.segments, segment{base: base, size: info.Size()})
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i].base < l.segments[j].base })
+	if len(l.segments) == 0 {
+		return l, l.roll()
+	}
+	last := &l.segments[len(l.segments)-1]
+	l.next = last.base
+	valid := int64(0)
+	err = l.scanSegment(*last, 0, 0, func(msg message, end int64) bool {
+		l.next = msg.offset + 1
+		valid = end
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(last.base)), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if valid < last.size {
+		log.Printf("durable log %s: truncating torn record at %d in %s", path, valid, segmentName(last.base))
+		if err := f.Truncate(valid); err != nil {
+			f.Close()
+			return nil, err
+		}
+		last.size = valid
+	}
+	l.active = f
+	return l, nil
+}
+
+// append writes msg to the log and returns its offset.
+func (l *durableLog) append(msg message) (uint64, error) {
+	l.Lock()
+	defer l.Unlock()
+	last := &l.segments[len(l.segments)-1]
+	if last.size >= l.d.SegmentBytes {
+		if err := l.roll(); err != nil {
+			return 0, err
+		}
+		last = &l.segments[len(l.segments)-1]
+	}
+	offset := l.next
+	rec := make([]byte, recordHeader, recordHeader+len(msg.key)+len(msg.text)+recordCRC)
+	binary.BigEndian.PutUint64(rec[0:], offset)
+	if !msg.expires.IsZero() {
+		binary.BigEndian.PutUint64(rec[8:], uint64(msg.expires.UnixNano()))
+	}
+	if msg.binary {
+		rec[16] |= flagBinary
+	}
+	if msg.retain {
+		rec[16] |= flagRetain
+	}
+	binary.BigEndian.PutUint16(rec[17:], uint16(len(msg.key)))
+	binary.BigEndian.PutUint32(rec[19:], uint32(len(msg.text)))
+	rec = append(rec, msg.key...)
+	rec = append(rec, msg.text...)
+	rec = binary.BigEndian.AppendUint32(rec, crc32.ChecksumIEEE(rec))
+	if _, err := l.active.Write(rec); err != nil {
+		return 0, err
+	}
+	last.size += int64(len(rec))
+	l.next++
+	if l.d.Fsync == fsyncAlways {
+		return offset, l.active.Sync()
+	}
+	l.dirty = true
+	return offset, nil
+}
+
+// roll starts a new segment and applies retention to the old ones.
+func (l *durableLog) roll() error {
+	if l.active != nil {
+		l.active.Sync()
+		l.active.Close()
+	}
+	f, err := os.OpenFile(filepath.Join(l.dir, segmentName(l.next)), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.active = f
+	l.dirty = false
+	l.segments = append(l.segments, segment{base: l.next})
+	l.retain()
+	return nil
+}
+
+// retain deletes the oldest segments, except the active one, while the
+// log is over RetainBytes or they are older than RetainAge.
+func (l *durableLog) retain() {
+	total := int64(0)
+	for _, s := range l.segments {
+		total += s.size
+	}
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		name := filepath.Join(l.dir, segmentName(s.base))
+		expired := false
+		if l.d.RetainAge.Duration > 0 {
+			if info, err := os.Stat(name); err == nil {
+				expired = time.Since(info.ModTime()) > l.d.RetainAge.Duration
+			}
+		}
+		if !expired && (l.d.RetainBytes == 0 || total <= l.d.RetainBytes) {
+			return
+		}
+		if err := os.Remove(name); err != nil {
+			log.Printf("durable log %s: %v", l.dir, err)
+			return
+		}
+		total -= s.size
+		l.segments = l.segments[1:]
+	}
+}
+
+func (l *durableLog) sync() {
+	l.Lock()
+	defer l.Unlock()
+	if l.dirty && l.active != nil {
+		l.active.Sync()
+		l.dirty = false
+	}
+}
+
+// close syncs and closes the active segment.
+func (l *durableLog) close() {
+	l.Lock()
+	defer l.Unlock()
+	if l.active != nil {
+		l.active.Sync()
+		l.active.Close()
+		l.active = nil
+	}
+}
+
+// position is a place in a log: a segment and a byte offset in its file.
+type position struct {
+	base uint64
+	pos  int64
+}
+
+// scan calls fn with each message at or after offset from, in order,
+// until fn returns false. at, if known from an earlier scan, is where
+// from is in the log, and saves reading up to it. fn receives each
+// message and the position after it.
+func (l *durableLog) scan(from uint64, at position, fn func(msg message, next position) bool) error {
+	l.Lock()
+	segments := append([]segment(nil), l.segments...)
+	l.Unlock()
+	for i, s := range segments {
+		if i+1 < len(segments) && segments[i+1].base <= from {
+			continue
+		}
+		start := int64(0)
+		if at.base == s.base {
+			start = at.pos
+		}
+		more := true
+		err := l.scanSegment(s, start, from, func(msg message, end int64) bool {
+			more = fn(msg, position{base: s.base, pos: end})
+			return more
+		})
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// logReader reads a log in order from an offset, keeping its place
+// between reads.
+type logReader struct {
+	l    *durableLog
+	from uint64   // offset of the next message
+	at   position // where it is, once known
+}
+
+// read returns up to max messages from the reader's place on, fewer once
+// it reaches the end of the log.
+func (r *logReader) read(max int) ([]message, error) {
+	var msgs []message
+	err := r.l.scan(r.from, r.at, func(msg message, next position) bool {
+		msgs = append(msgs, msg)
+		r.from, r.at = msg.offset+1, next
+		return len(msgs) < max
+	})
+	return msgs, err
+}
+
+// tail returns the last n messages, less any that have expired.
+func (l *durableLog) tail(n int) []message {
+	l.Lock()
+	from := uint64(1)
+	if l.next > uint64(n) {
+		from = l.next - uint64(n)
+	}
+	l.Unlock()
+	var msgs []message
+	now := time.Now()
+	l.scan(from, position{}, func(msg message, next position) bool {
+		if !msg.expired(now) {
+			msgs = append(msgs, msg)
+		}
+		return true
+	})
+	return msgs
+}
+
+// scanSegment reads the records of s from file position start with
+// offsets at or after from. It stops quietly at the first torn or corrupt
+// record. fn receives each message and the file position after it.
+func (l *durableLog) scanSegment(s segment, start int64, from uint64, fn func(msg message, end int64) bool) error {
+	f, err := os.Open(filepath.Join(l.dir, segmentName(s.base)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // removed by retention
+		}
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	header := make([]byte, recordHeader)
+	pos := start
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			return nil
+		}
+		keySize := int(binary.BigEndian.Uint16(header[17:]))
+		size := keySize + int(binary.BigEndian.Uint32(header[19:]))
+		if int64(size) > info.Size() {
+			return nil // a corrupt length
+		}
+		rest := make([]byte, size+recordCRC)
+		if _, err := io.ReadFull(f, rest); err != nil {
+			return nil
+		}
+		crc := crc32.NewIEEE()
+		crc.Write(header)
+		crc.Write(rest[:size])
+		if crc.Sum32() != binary.BigEndian.Uint32(rest[size:]) {
+			return nil
+		}
+		pos += int64(recordHeader) + int64(len(rest))
+		msg := message{
+			text:   rest[keySize:size:size],
+			binary: header[16]&flagBinary != 0,
+			retain: header[16]&flagRetain != 0,
+			key:    string(rest[:keySize]),
+			offset: binary.BigEndian.Uint64(header[0:]),
+		}
+		if expires := binary.BigEndian.Uint64(header[8:]); expires != 0 {
+			msg.expires = time.Unix(0, int64(expires))
+		}
+		if msg.offset < from {
+			continue
+		}
+		if !fn(msg, pos) {
+			return nil
+		}
+	}
+}
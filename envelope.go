@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// envelope is the JSON form of a message sent to subscribers that connect
+// with an envelope parameter, and of every request. Text messages are in
+// Text and binary ones base64 encoded in Data.
+type envelope struct {
+	ID     uint64 `json:"id,omitempty"`
+	Offset uint64 `json:"offset,omitempty"`
+	Reply  string `json:"reply,omitempty"`
+	Retain bool   `json:"retain,omitempty"`
+	Key    string `json:"key,omitempty"`
+	Text   string `json:"text,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+
+	// TTL is only read, from messages published in envelopes.
+	TTL *duration `json:"ttl,omitempty"`
+}
+
+func (msg message) envelope() []byte {
+	env := envelope{ID: msg.id, Offset: msg.offset, Reply: msg.replyTo, Retain: msg.retain, Key: msg.key}
+	if msg.binary {
+		env.Data = msg.text
+	} else {
+		env.Text = string(msg.text)
+	}
+	b, _ := json.Marshal(env)
+	return b
+}
+
+// openEnvelope returns the message a client in envelope mode published,
+// with its metadata.
+func openEnvelope(text []byte, now time.Time) (message, error) {
+	var env envelope
+	if err := json.Unmarshal(text, &env); err != nil {
+		return message{}, err
+	}
+	if len(env.Key) > idempotencyKeyMax {
+		return message{}, fmt.Errorf("key can be at most %d bytes", idempotencyKeyMax)
+	}
+	msg := message{text: []byte(env.Text), retain: env.Retain, key: env.Key}
+	if env.Data != nil {
+		msg.text, msg.binary = env.Data, true
+	}
+	if env.TTL != nil {
+		if env.TTL.Duration <= 0 {
+			return message{}, errors.New("ttl must be positive")
+		}
+		msg.expires = now.Add(env.TTL.Duration)
+	}
+	return msg, nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+)
+
+// messageFilter transforms or drops a message before a channel fans it
+// out. It returns the message to publish, or false to drop it.
+//
+// Custom filters are compiled into the binary by registering a
+// constructor from an init function:
+//
+//     func init() {
+//         registerFilter("myfilter", func(args json.RawMessage) (messageFilter, error) {
+//             return myFilter{}, nil
+//         })
+//     }
+type messageFilter interface {
+	apply(msg message) (message, bool)
+}
+
+// filterConstructor builds a filter from the Args of its config.
+type filterConstructor func(args json.RawMessage) (messageFilter, error)
+
+var filterConstructors = map[string]filterConstructor{}
+
+func registerFilter(name string, constructor filterConstructor) {
+	filterConstructors[name] = constructor
+}
+
+// filterConfig names a registered filter and its arguments.
+type filterConfig struct {
+	Name string
+	Args json.RawMessage
+}
+
+type filterChain []messageFilter
+
+// newFilterChain builds the filters in fcs, in order.
+func newFilterChain(fcs []filterConfig) (filterChain, error) {
+	var chain filterChain
+	for _, fc := range fcs {
+		constructor, ok := filterConstructors[fc.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter %q", fc.Name)
+		}
+		f, err := constructor(fc.Args)
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %v", fc.Name, err)
+		}
+		chain = append(chain, f)
+	}
+	return chain, nil
+}
+
+// apply runs msg through every filter until one drops it.
+func (chain filterChain) apply(msg message) (message, bool) {
+	for _, f := range chain {
+		var ok bool
+		if msg, ok = f.apply(msg); !ok {
+			return msg, false
+		}
+	}
+	return msg, true
+}
+
+// decodeArgs unmarshals filter args into v, allowing no args.
+func decodeArgs(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	return json.Unmarshal(args, v)
+}
+
+func init() {
+	registerFilter("size", newSizeFilter)
+	registerFilter("regexdrop", newRegexDropFilter)
+	registerFilter("jsonschema", newSchemaFilter)
+	registerFilter("strip", newStripFilter)
+	registerFilter("timestamp", newTimestampFilter)
+	registerFilter("sender", newSenderFilter)
+}
+
+// sizeFilter drops messages longer than Max bytes.
+type sizeFilter struct {
+	Max int
+}
+
+func newSizeFilter(args json.RawMessage) (messageFilter, error) {
+	f := sizeFilter{}
+	if err := decodeArgs(args, &f); err != nil {
+		return nil, err
+	}
+	if f.Max < 1 {
+		return nil, fmt.Errorf("Max must be positive")
+	}
+	return f, nil
+}
+
+func (f sizeFilter) apply(msg message) (message, bool) {
+	return msg, len(msg.text) <= f.Max
+}
+
+// regexDropFilter drops messages matching Pattern.
+type regexDropFilter struct {
+	re *regexp.Regexp
+}
+
+func newRegexDropFilter(args json.RawMessage) (messageFilter, error) {
+	var a struct{ Pattern string }
+	if err := decodeArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if a.Pattern == "" {
+		// An empty pattern would drop every message.
+		return nil, fmt.Errorf("Pattern is required")
+	}
+	re, err := regexp.Compile(a.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	return regexDropFilter{re}, nil
+}
+
+func (f regexDropFilter) apply(msg message) (message, bool) {
+	return msg, !f.re.Match(msg.text)
+}
+
+// schemaFilter drops messages that are not JSON matching Schema, a
+// subset of JSON Schema: type, required, properties and items.
+type schemaFilter struct {
+	schema *schema
+}
+
+type schema struct {
+	Type       string
+	Required   []string
+	Properties map[string]*schema
+	Items      *schema
+}
+
+func newSchemaFilter(args json.RawMessage) (messageFilter, error) {
+	var a struct{ Schema *schema }
+	if err := decodeArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return schemaFilter{a.Schema}, nil
+}
+
+func (f schemaFilter) apply(msg message) (message, bool) {
+	var v interface{}
+	if msg.binary || json.Unmarshal(msg.text, &v) != nil {
+		return msg, false
+	}
+	return msg, f.schema.valid(v)
+}
+
+func (s *schema) valid(v interface{}) bool {
+	if s == nil {
+		return true
+	}
+	switch s.Type {
+	case "":
+	case "object":
+		if _, ok := v.(map[string]interface{}); !ok {
+			return false
+		}
+	case "array":
+		if _, ok := v.([]interface{}); !ok {
+			return false
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return false
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return false
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != math.Trunc(n) {
+			return false
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return false
+		}
+	case "null":
+		if v != nil {
+			return false
+		}
+	default:
+		return false
+	}
+	if obj, ok := v.(map[string]interface{}); ok {
+		for _, key := range s.Required {
+			if _, ok := obj[key]; !ok {
+				return false
+			}
+		}
+		for key, prop := range s.Properties {
+			if pv, ok := obj[key]; ok && !prop.valid(pv) {
+				return false
+			}
+		}
+	}
+	if arr, ok := v.([]interface{}); ok && s.Items != nil {
+		for _, item := range arr {
+			if !s.Items.valid(item) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// objectFilter rewrites the fields of JSON object messages. Other
+// messages pass unchanged.
+type objectFilter func(msg message, obj map[string]json.RawMessage)
+
+func (f objectFilter) apply(msg message) (message, bool) {
+	var obj map[string]json.RawMessage
+	if msg.binary || json.Unmarshal(msg.text, &obj) != nil || obj == nil {
+		return msg, true
+	}
+	f(msg, obj)
+	text, err := json.Marshal(obj)
+	if err != nil {
+		return msg, true
+	}
+	msg.text = text
+	return msg, true
+}
+
+// newStripFilter removes Fields from JSON objects.
+func newStripFilter(args json.RawMessage) (messageFilter, error) {
+	var a struct{ Fields []string }
+	if err := decodeArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return objectFilter(func(msg message, obj map[string]json.RawMessage) {
+		for _, field := range a.Fields {
+			delete(obj, field)
+		}
+	}), nil
+}
+
+// newTimestampFilter sets Field (default "ts") of JSON objects to the
+// server time in RFC 3339 format.
+func newTimestampFilter(args json.RawMessage) (messageFilter, error) {
+	a := struct{ Field string }{Field: "ts"}
+	if err := decodeArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return objectFilter(func(msg message, obj map[string]json.RawMessage) {
+		obj[a.Field], _ = json.Marshal(time.Now().UTC().Format(time.RFC3339Nano))
+	}), nil
+}
+
+// newSenderFilter sets Field (default "sender") of JSON objects to the
+// publisher's identity, or its IP address if it has none.
+func newSenderFilter(args json.RawMessage) (messageFilter, error) {
+	a := struct{ Field string }{Field: "sender"}
+	if err := decodeArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return objectFilter(func(msg message, obj map[string]json.RawMessage) {
+		obj[a.Field], _ = json.Marshal(msg.sender)
+	}), nil
+}
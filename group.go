@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Consumer group balancing: how a channel picks the one member of a group
+// that receives each message.
+const (
+	balanceRoundRobin = "roundrobin" // members in turn (default)
+	balanceLeast      = "least"      // the member with the fewest queued messages
+)
+
+// groupNameMax bounds consumer group names in bytes.
+const groupNameMax = 64
+
+// group is a named set of subscribers of one channel that share its
+// messages: each message goes to exactly one member.
+type group struct {
+	members []*connection
+	next    int
+}
+
+type groups map[string]*group
+
+// groupParam parses the group connect parameter.
+func groupParam(q url.Values) (string, error) {
+	if !q.Has("group") {
+		return "", nil
+	}
+	name := q.Get("group")
+	if name == "" || len(name) > groupNameMax {
+		return "", fmt.Errorf("group name must be 1-%d bytes", groupNameMax)
+	}
+	return name, nil
+}
+
+// join adds conn to its group, creating the group if needed.
+func (c *channel) join(conn *connection) {
+	g, ok := c.groups[conn.group]
+	if !ok {
+		g = &group{}
+		c.groups[conn.group] = g
+	}
+	g.members = append(g.members, conn)
+}
+
+// leave removes conn from its group, forgetting the group once empty.
+func (c *channel) leave(conn *connection) {
+	g, ok := c.groups[conn.group]
+	if !ok {
+		return
+	}
+	for i, member := range g.members {
+		if member == conn {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	if len(g.members) == 0 {
+		delete(c.groups, conn.group)
+	}
+}
+
+// dispatch sends msg to one member of each group whose filter matches it
+// and returns the number of groups reached. A member with a full send
+// buffer is passed over for the next one; if every matching member is
+// full the message is dropped for that group.
+func (c *channel) dispatch(msg message, pm *parsedMessage) int {
+	n := 0
+	for _, g := range c.groups {
+		full := false
+	members:
+		for _, conn := range g.candidates(c.policy.groupBalance) {
+			if !conn.filter.match(pm) {
+				continue
+			}
+			select {
+			case conn.send <- msg:
+				g.advance(conn)
+				n++
+				full = false
+				break members
+			default:
+				full = true
+			}
+		}
+		if full {
+			mark("slowdrops", 1)
+		}
+	}
+	return n
+}
+
+// candidates returns the members of g in the order they should be offered
+// the next message.
+func (g *group) candidates(balance string) []*connection {
+	if len(g.members) == 0 {
+		return nil
+	}
+	ordered := make([]*connection, 0, len(g.members))
+	if balance == balanceLeast {
+		ordered = append(ordered, g.members...)
+		// Insertion sort by queue length; groups are small.
+		for i := 1; i < len(ordered); i++ {
+			for j := i; j > 0 && len(ordered[j].send) < len(ordered[j-1].send); j-- {
+				ordered[j], ordered[j-1] = ordered[j-1], ordered[j]
+			}
+		}
+		return ordered
+	}
+	g.next %= len(g.members)
+	ordered = append(ordered, g.members[g.next:]...)
+	return append(ordered, g.members[:g.next]...)
+}
+
+// advance makes the member after conn the next in turn.
+func (g *group) advance(conn *connection) {
+	for i, member := range g.members {
+		if member == conn {
+			g.next = i + 1
+			return
+		}
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"io/ioutil"
-	"log"
+	"mime"
 	"net/http"
-	"net/url"
+	"time"
 	"unicode/utf8"
 )
 
@@ -15,60 +16,85 @@ type wsHandler struct {
 	upgrader *websocket.Upgrader
 }
 
-func newWsHandler(hub *hub, origin string) wsHandler {
+func newWsHandler(hub *hub) wsHandler {
+	cfg := hub.config()
 	return wsHandler{
 		hub: hub,
 		upgrader: &websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin:     wsOriginChecker(origin),
+			ReadBufferSize:  cfg.ReadBufferSize,
+			WriteBufferSize: cfg.WriteBufferSize,
+			CheckOrigin: func(r *http.Request) bool {
+				return hub.config().checkOrigin(r)
+			},
 		},
 	}
 }
 
-func wsOriginChecker(origin string) func(r *http.Request) bool {
-	if origin == "" {
-		return func(r *http.Request) bool {
-			return true
-		}
+func (wsh wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := wsh.hub.config()
+	if !validateRequest(cfg, w, r) {
+		return
 	}
-
-	serverOriginURL, err := url.Parse(origin)
+	ip, identity := cfg.remoteIP(r), cfg.identity(r)
+	if !wsh.hub.allowConnect(ip, identity, r.URL.Path) {
+		mark("connlimits", 1)
+		sendTooManyRequestsError(w)
+		return
+	}
+	if isReplyPath(r.URL.Path) {
+		http.Error(w, "Error: reply paths can't be subscribed.", http.StatusForbidden)
+		return
+	}
+	filter, err := newSubscriberFilter(r.URL.Query())
 	if err != nil {
-		log.Fatal("Failed to parse origin", origin, err)
+		sendBadRequestError(w, err.Error())
+		return
 	}
-	return func(r *http.Request) bool {
-		o := r.Header["Origin"]
-		if len(o) == 0 {
-			return true
-		}
-		clientOrigin := o[0]
-		if clientOrigin == origin {
-			return true
-		}
-		clientOriginURL, err := url.Parse(clientOrigin)
-		if err != nil {
-			return false
-		}
-		if clientOriginURL.Scheme != serverOriginURL.Scheme {
-			return false
-		}
-		if clientOriginURL.Host != serverOriginURL.Host {
-			return false
-		}
-		return true
+	replay, offset, err := replayOffset(r.URL.Query())
+	if err != nil {
+		sendBadRequestError(w, err.Error())
+		return
 	}
-}
-
-func (wsh wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !validateRequest(w, r) {
+	ack, subscriber, err := ackParams(r.URL.Query())
+	if err != nil {
+		sendBadRequestError(w, err.Error())
 		return
 	}
+	group, err := groupParam(r.URL.Query())
+	if err != nil {
+		sendBadRequestError(w, err.Error())
+		return
+	}
+	if ack && group != "" {
+		sendBadRequestError(w, "A group member can't use ack.")
+		return
+	}
+	if replay && (ack || group != "") {
+		sendBadRequestError(w, "An offset can't be combined with ack or group.")
+		return
+	}
+	ok, status, reason := wsh.hub.conns.acquire(cfg, ip, r.URL.Path)
+	if !ok {
+		mark("connrejects", 1)
+		http.Error(w, "Error: connection refused. "+reason, status)
+		return
+	}
+	defer wsh.hub.conns.release(ip, r.URL.Path)
 	ws, err := wsh.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
-	c := newConnection(ws, wsh.hub, r.URL.Path)
+	c := newConnection(ws, wsh.hub, r.URL.Path, ip, identity)
+	// Presence uses the authenticated identity or else the one given.
+	if c.member = identity; c.member == "" {
+		c.member = r.URL.Query().Get("id")
+	}
+	c.filter = filter
+	c.replay, c.offset = replay, offset
+	c.ack, c.subscriber = ack, subscriber
+	c.group = group
+	// Ack-mode clients need the IDs carried by envelopes.
+	c.envelope = ack || r.URL.Query().Has("envelope")
 	c.run()
 }
 
@@ -77,7 +103,11 @@ type getHandler struct {
 }
 
 func (gh getHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !validateRequest(w, r) {
+	if !validateRequest(gh.hub.config(), w, r) {
+		return
+	}
+	if r.URL.Query().Has("presence") {
+		servePresence(gh.hub, w, r)
 		return
 	}
 	webTemplate.Execute(w, templateArgs{r.URL.Path})
@@ -88,29 +118,156 @@ type postHandler struct {
 }
 
 func (ph postHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !validateRequest(w, r) {
+	cfg := ph.hub.config()
+	if !validateRequest(cfg, w, r) {
+		return
+	}
+	paths, multicast := r.URL.Query()["path"]
+	targets := []string{r.URL.Path}
+	if multicast {
+		for _, p := range paths {
+			if !validatePath(cfg, w, p) {
+				return
+			}
+		}
+		// Limits apply to the paths reached, not to the patterns.
+		if targets = ph.hub.resolve(paths); len(targets) == 0 {
+			targets = paths
+		}
+	}
+	if !cfg.corsPaths(w, r, targets) {
+		return
+	}
+	if !ph.hub.allowPublishAll(cfg, cfg.remoteIP(r), cfg.identity(r), targets) {
+		mark("publimits", 1)
+		sendTooManyRequestsError(w)
 		return
 	}
-	body, err := ioutil.ReadAll(r.Body)
+	// A multicast body must fit the smallest limit among its targets.
+	limit := cfg.messageLimit(targets[0])
+	for _, p := range targets[1:] {
+		if l := cfg.messageLimit(p); l < limit {
+			limit = l
+		}
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf(
+				"Error: message too large. Limit is %d bytes.", limit),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
 		sendBadRequestError(w, "Unable to read POST body.")
 		return
 	}
-	ph.hub.queue <- command{cmd: PUBLISH, path: r.URL.Path, text: body}
+	msg := message{
+		text:   body,
+		binary: isBinaryContentType(r.Header.Get("Content-Type")),
+		sender: cfg.identity(r),
+	}
+	if !msg.binary && !utf8.Valid(body) {
+		// Browsers close websockets that receive invalid text frames.
+		sendBadRequestError(w, "A text message must be valid UTF-8.")
+		return
+	}
+	if msg.sender == "" {
+		msg.sender = cfg.remoteIP(r)
+	}
+	at, scheduled, err := cfg.deliverAt(r)
+	if err != nil {
+		sendBadRequestError(w, err.Error())
+		return
+	}
+	expiry, err := ttl(r)
+	if err != nil {
+		sendBadRequestError(w, err.Error())
+		return
+	}
+	if msg.retain, err = retain(r); err != nil {
+		sendBadRequestError(w, err.Error())
+		return
+	}
+	if msg.key, err = idempotencyKey(r); err != nil {
+		sendBadRequestError(w, err.Error())
+		return
+	}
+	if msg.retain && len(body) == 0 && !multicast {
+		// An empty retained message clears the path's, in order with
+		// the messages published before it.
+		ph.hub.queue <- command{cmd: PUBLISH, path: r.URL.Path, message: msg}
+		w.Write([]byte("OK\n"))
+		return
+	}
+	if scheduled {
+		if multicast || r.URL.Query().Has("reply") {
+			sendBadRequestError(w, "A scheduled message can't be multicast or a request.")
+			return
+		}
+		ph.serveSchedule(cfg, w, r, msg, at, expiry)
+		return
+	}
+	if expiry > 0 {
+		msg.expires = time.Now().Add(expiry)
+	}
+	if r.URL.Query().Has("reply") {
+		if multicast {
+			sendBadRequestError(w, "A request can't be multicast.")
+			return
+		}
+		ph.serveRequest(cfg, w, r, msg)
+		return
+	}
+	if multicast {
+		ph.multicast(w, targets, msg)
+		return
+	}
+	ph.hub.queue <- command{cmd: PUBLISH, path: r.URL.Path, message: msg}
 	w.Write([]byte("OK\n"))
 	mark("postmsgs", 1)
 }
 
-func validateRequest(w http.ResponseWriter, r *http.Request) bool {
-	if !utf8.ValidString(r.URL.Path) {
+// multicast publishes msg to every path (or pattern) in paths with one
+// hub round trip and reports the number of subscribers reached.
+func (ph postHandler) multicast(w http.ResponseWriter, paths []string, msg message) {
+	reply := make(chan int, 1)
+	ph.hub.queue <- command{cmd: MULTICAST, paths: paths, message: msg, reply: reply}
+	fmt.Fprintf(w, "OK %d\n", <-reply)
+	mark("postmsgs", 1)
+}
+
+// binaryContentTypes are the POST media types published as binary messages.
+var binaryContentTypes = map[string]bool{
+	"application/octet-stream": true,
+	"application/protobuf":     true,
+	"application/x-protobuf":   true,
+	"application/msgpack":      true,
+	"application/x-msgpack":    true,
+}
+
+func isBinaryContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return binaryContentTypes[mediaType]
+}
+
+func validateRequest(cfg *config, w http.ResponseWriter, r *http.Request) bool {
+	return validatePath(cfg, w, r.URL.Path)
+}
+
+func validatePath(cfg *config, w http.ResponseWriter, path string) bool {
+	if !utf8.ValidString(path) {
 		sendBadRequestError(w, "Path must be valid Unicode (UTF-8).")
 		return false
 	}
-	pathLen := utf8.RuneCountInString(r.URL.Path)
-	if !(pathLenMin <= pathLen && pathLen <= pathLenMax) {
+	pathLen := utf8.RuneCountInString(path)
+	if !(cfg.PathLenMin <= pathLen && pathLen <= cfg.PathLenMax) {
 		sendBadRequestError(w, fmt.Sprintf(
 			"Path length must be %d-%d Unicode characters (UTF-8).",
-			pathLenMin, pathLenMax))
+			cfg.PathLenMin, cfg.PathLenMax))
 		return false
 	}
 	return true
@@ -121,3 +278,9 @@ func sendBadRequestError(w http.ResponseWriter, str string) {
 		fmt.Sprintf("Error: bad request. %s", str),
 		http.StatusBadRequest)
 }
+
+func sendTooManyRequestsError(w http.ResponseWriter) {
+	http.Error(w,
+		"Error: rate limit exceeded. Try again later.",
+		http.StatusTooManyRequests)
+}
@@ -2,32 +2,190 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"sync/atomic"
 )
 
 type hub struct {
 	queue    queue
 	channels channels
+	cfg      atomic.Pointer[config]
+
+	publishLimiter atomic.Pointer[rateLimiter]
+	connectLimiter atomic.Pointer[rateLimiter]
+	conns          *connCounter
+	logs           *logStore
+	acks           *ackStore
+	sched          *scheduler
+	retained       *retainStore
+	dedups         *dedupStore
 }
 
 type channels map[string]*channel
 
-func newHub() *hub {
-	return &hub{
+func newHub(cfg *config) *hub {
+	h := &hub{
 		queue:    make(queue, 16),
 		channels: make(channels),
+		conns:    newConnCounter(),
+		logs:     newLogStore(cfg.Durability),
+		acks:     newAckStore(),
+		retained: newRetainStore(),
+		dedups:   newDedupStore(),
+	}
+	h.sched = newScheduler(h.queue, cfg.ScheduleFile)
+	h.setConfig(cfg)
+	return h
+}
+
+// config returns the current config. Callers should keep the result for
+// the duration of one request so they see consistent settings.
+func (h *hub) config() *config {
+	return h.cfg.Load()
+}
+
+// setConfig replaces the current config. Rate limiters are replaced only
+// when their limits change so that existing buckets are kept.
+func (h *hub) setConfig(cfg *config) {
+	old := h.cfg.Load()
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if old != nil && i < len(old.Rules) && r.equal(&old.Rules[i]) {
+			r.limiter = old.Rules[i].limiter
+		} else {
+			r.limiter = newRateLimiter(r.PublishLimit)
+		}
+		if chain, err := newFilterChain(r.Filters); err != nil {
+			log.Printf("rule %q: %v", r.Pattern, err)
+		} else {
+			r.filters = chain
+		}
+	}
+	queues := make(map[string]*webhookQueue)
+	if old != nil {
+		for _, wh := range old.Webhooks {
+			queues[wh.URL] = wh.queue
+		}
+	}
+	for i := range cfg.Webhooks {
+		wh := &cfg.Webhooks[i]
+		if old != nil && i < len(old.Webhooks) && wh.equal(&old.Webhooks[i]) {
+			wh.limiter = old.Webhooks[i].limiter
+		} else {
+			wh.limiter = newLimiter(wh.Limit)
+		}
+		// Webhooks for one URL share a queue, kept across reloads.
+		if queues[wh.URL] == nil {
+			queues[wh.URL] = &webhookQueue{}
+		}
+		wh.queue = queues[wh.URL]
+	}
+	h.cfg.Store(cfg)
+	if old == nil || old.PublishLimit != cfg.PublishLimit {
+		h.publishLimiter.Store(newRateLimiter(cfg.PublishLimit))
+	}
+	if old == nil || old.ConnectLimit != cfg.ConnectLimit {
+		h.connectLimiter.Store(newRateLimiter(cfg.ConnectLimit))
 	}
 }
 
+// allowPublish checks the global publish limits and those of the rules in
+// p for path. Tokens are only spent if every limit allows it.
+func (h *hub) allowPublish(p policy, ip, identity, path string) bool {
+	var taken tokens
+	if !h.takePublish(&taken, p, ip, identity, path) {
+		taken.refund()
+		return false
+	}
+	return true
+}
+
+// allowPublishAll checks the publish limits of one message to each of
+// paths, such as the targets of a multicast, each under its own rules.
+// Each limiter's ip and identity buckets are charged once and its path
+// bucket once per path. Tokens are only spent if every limit allows it.
+func (h *hub) allowPublishAll(cfg *config, ip, identity string, paths []string) bool {
+	var taken tokens
+	global := h.publishLimiter.Load()
+	charged := map[*rateLimiter]bool{global: true}
+	ok := global.takeSender(&taken, ip, identity)
+	for _, path := range paths {
+		if !ok {
+			break
+		}
+		ok = global.takePath(&taken, path)
+		if l := cfg.policy(path).limiter; ok && l != nil {
+			if !charged[l] {
+				charged[l] = true
+				ok = l.takeSender(&taken, ip, identity)
+			}
+			ok = ok && l.takePath(&taken, path)
+		}
+	}
+	if !ok {
+		taken.refund()
+	}
+	return ok
+}
+
+// takePublish takes the tokens allowPublish needs into taken, and reports
+// whether every limit had one.
+func (h *hub) takePublish(taken *tokens, p policy, ip, identity, path string) bool {
+	if !h.publishLimiter.Load().take(taken, ip, identity, path) {
+		return false
+	}
+	return p.limiter == nil || p.limiter.take(taken, ip, identity, path)
+}
+
+func (h *hub) allowConnect(ip, identity, path string) bool {
+	return h.connectLimiter.Load().allow(ip, identity, path)
+}
+
 func newChannel(h *hub, path string) *channel {
-	return &channel{
+	c := &channel{
 		queue:       make(queue, 16),
 		connections: make(connections),
+		groups:      make(groups),
+		catchups:    make(map[*connection]*catchup),
 		h:           h,
 		path:        path,
+		policy:      h.config().policy(path),
 	}
+	return c
+}
+
+// persist keeps a message published to a path with no channel. It is
+// appended to the path's durable log in the background if the path is
+// durable, recorded for ack-mode subscribers, and retained if flagged. An
+// empty retained message clears the path's instead.
+func (h *hub) persist(path string, msg message) {
+	if len(msg.text) == 0 {
+		if msg.retain {
+			h.retained.clear(path)
+		}
+		return
+	}
+	cfg := h.config()
+	if h.dedups.duplicate(cfg, path, msg) {
+		return
+	}
+	p := cfg.policy(path)
+	msg, ok := p.filters.apply(msg)
+	if !ok {
+		mark("filterdrops", 1)
+		return
+	}
+	if p.durable {
+		h.logs.appendLater(path, msg)
+	}
+	if msg.retain {
+		h.retained.set(path, msg, cfg.MaxRetained)
+	}
+	h.acks.record(cfg, path, msg)
 }
 
 func (h *hub) run() {
+	go h.sched.run()
 	for cmd := range h.queue {
 		// Forward cmds to their path's channel queues.
 		switch cmd.cmd {
@@ -37,6 +195,14 @@ func (h *hub) run() {
 			h.publish(cmd)
 		case REMOVE:
 			h.remove(cmd)
+		case MULTICAST:
+			h.multicast(cmd)
+		case PRESENCE:
+			h.queryPresence(cmd)
+		case COUNT:
+			h.countPaths(cmd)
+		case MATCH:
+			h.matchPaths(cmd)
 		default:
 			panic(fmt.Sprintf("unexpected hub cmd: %v\n", cmd))
 		}
@@ -48,27 +214,154 @@ func (h *hub) subscribe(cmd command) {
 	if _, ok := h.channels[cmd.path]; !ok {
 		h.channels[cmd.path] = newChannel(h, cmd.path)
 		go h.channels[cmd.path].run()
+		h.config().notify(eventCreate, cmd.path)
 	}
 	// Give the connection a reference to its own channel.
-	cmd.conn.control <- h.channels[cmd.path]
-	h.channels[cmd.path].queue <- cmd
+	channel := h.channels[cmd.path]
+	cmd.conn.control <- channel
+	channel.subscribes++
+	channel.queue <- cmd
 }
 
 func (h *hub) publish(cmd command) {
 	if channel, ok := h.channels[cmd.path]; ok {
 		select {
 		case channel.queue <- cmd:
+			return
 		default:
 			// Tried publishing to a closing channel.
-			h.remove(cmd)
+			h.remove(command{cmd: REMOVE, path: cmd.path, channel: channel})
 		}
-	} else {
+	} else if len(cmd.text) > 0 {
 		mark("drops", 1)
 	}
+	if cmd.replyTo == "" {
+		// A request is only for subscribers there now.
+		h.persist(cmd.path, cmd.message)
+	}
+	if cmd.reply != nil {
+		cmd.reply <- 0
+	}
 }
 
+// remove forgets cmd.channel unless its path has a newer channel. A
+// channel asking to be removed is refused if a subscriber is on its way
+// to it.
 func (h *hub) remove(cmd command) {
-	if _, ok := h.channels[cmd.path]; ok {
+	if cmd.removed != nil && cmd.channel.subscribes != cmd.subscribed {
+		cmd.removed <- false
+		return
+	}
+	if h.channels[cmd.path] == cmd.channel {
 		delete(h.channels, cmd.path)
+		h.config().notify(eventRemove, cmd.path)
+	}
+	if cmd.removed != nil {
+		cmd.removed <- true
+	}
+}
+
+// multicast forwards one message to every live channel matched by
+// cmd.paths and replies with the total number of subscribers reached.
+func (h *hub) multicast(cmd command) {
+	targets := h.match(cmd.paths)
+	replies := make(chan int, len(targets))
+	for _, channel := range targets {
+		select {
+		case channel.queue <- command{cmd: PUBLISH, path: channel.path, message: cmd.message, reply: replies}:
+		default:
+			// Tried publishing to a closing channel.
+			h.remove(command{cmd: REMOVE, path: channel.path, channel: channel})
+			replies <- 0
+		}
+	}
+	if len(targets) == 0 {
+		mark("drops", 1)
+	}
+	go func(n int) {
+		total := 0
+		for i := 0; i < n; i++ {
+			total += max(<-replies, 0)
+		}
+		cmd.reply <- total
+	}(len(targets))
+}
+
+// match returns the live channels matched by any of paths.
+// resolve returns the paths a multicast to paths reaches: each path, and
+// the live paths matching each pattern.
+func (h *hub) resolve(paths []string) []string {
+	reply := make(chan []string, 1)
+	h.queue <- command{cmd: MATCH, paths: paths, matches: reply}
+	return <-reply
+}
+
+func (h *hub) matchPaths(cmd command) {
+	var matches []string
+	seen := make(map[string]bool)
+	for _, p := range cmd.paths {
+		if !isPattern(p) {
+			if !seen[p] {
+				seen[p] = true
+				matches = append(matches, p)
+			}
+			continue
+		}
+		for path := range h.channels {
+			if matchPath(p, path) && !seen[path] {
+				seen[path] = true
+				matches = append(matches, path)
+			}
+		}
+	}
+	cmd.matches <- matches
+}
+
+func (h *hub) match(paths []string) []*channel {
+	found := make(map[*channel]struct{})
+	for _, p := range paths {
+		if !isPattern(p) {
+			if channel, ok := h.channels[p]; ok {
+				found[channel] = struct{}{}
+			}
+			continue
+		}
+		for path, channel := range h.channels {
+			if matchPath(p, path) {
+				found[channel] = struct{}{}
+			}
+		}
+	}
+	targets := make([]*channel, 0, len(found))
+	for channel := range found {
+		targets = append(targets, channel)
+	}
+	return targets
+}
+
+// queryPresence forwards a presence query to the path's channel, if any.
+func (h *hub) queryPresence(cmd command) {
+	if channel, ok := h.channels[cmd.path]; ok {
+		select {
+		case channel.queue <- cmd:
+			return
+		default:
+			// Tried querying a closing channel.
+			h.remove(command{cmd: REMOVE, path: cmd.path, channel: channel})
+		}
+	}
+	cmd.presence <- presence{Path: cmd.path, Members: []string{}}
+}
+
+// countPaths replies with the subscriber count of each path in cmd.paths,
+// without creating channels.
+func (h *hub) countPaths(cmd command) {
+	counts := make(map[string]int, len(cmd.paths))
+	for _, path := range cmd.paths {
+		counts[path] = 0
+		if channel, ok := h.channels[path]; ok {
+			counts[path] = int(channel.subscribers.Load())
+		}
 	}
+	cmd.counts <- counts
 }
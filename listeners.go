@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Operations a listener can allow.
+const (
+	opSubscribe = "subscribe" // websockets and the HTML client
+	opPublish   = "publish"   // POST, DELETE
+	opAdmin     = "admin"     // channel queries
+)
+
+var allOps = []string{opSubscribe, opPublish, opAdmin}
+
+// listener is an address to serve and the operations allowed on it.
+type listener struct {
+	// Addr is a TCP address or an absolute path for a UNIX socket.
+	Addr string
+
+	// Ops lists the allowed operations. Empty allows all of them.
+	Ops []string
+}
+
+type listeners []listener
+
+func (l listener) allows(op string) bool {
+	if len(l.Ops) == 0 {
+		return true
+	}
+	for _, o := range l.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// listeners returns the configured listeners, or one listener on Addr
+// allowing every operation.
+func (c *config) listeners() listeners {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	return listeners{{Addr: c.Addr}}
+}
+
+// validate reports problems with each listener through fail.
+func (ls listeners) validate(fail func(format string, a ...interface{})) {
+	seen := make(map[string]bool)
+	for _, l := range ls {
+		if l.Addr == "" {
+			fail("Listeners: Addr is required")
+		}
+		if seen[l.Addr] {
+			fail("Listeners: %q is listed twice", l.Addr)
+		}
+		seen[l.Addr] = true
+		for _, op := range l.Ops {
+			if !(listener{Ops: allOps}).allows(op) {
+				fail("Listeners %q: unknown operation %q (want %s)", l.Addr, op, strings.Join(allOps, ", "))
+			}
+		}
+	}
+}
+
+func (ls listeners) String() string {
+	s := []string{}
+	for _, l := range ls {
+		s = append(s, l.Addr+"="+strings.Join(l.Ops, ","))
+	}
+	return strings.Join(s, " ")
+}
+
+// Set parses an addr=op,op flag value.
+func (ls *listeners) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 1 {
+		return fmt.Errorf("expected addr=op[,op], got %q", value)
+	}
+	*ls = append(*ls, listener{Addr: value[:i], Ops: strings.Split(value[i+1:], ",")})
+	return nil
+}
+
+// forbidden refuses an operation not allowed on a listener.
+type forbidden string
+
+func (op forbidden) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	http.Error(w,
+		fmt.Sprintf("Error: forbidden. %s is not allowed on this listener.", op),
+		http.StatusForbidden)
+}
@@ -10,24 +10,30 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
-	// Prepare the HTTP server
-	server := &http.Server{
-		Addr: "127.0.0.1:8081",
+	if err := run(); err != nil {
+		os.Exit(1)
 	}
+}
 
-	metricsPort := "8082"
-	flag.StringVar(&metricsPort, "mport", metricsPort, "metrics service port")
-	flag.StringVar(&server.Addr, "addr", server.Addr, "http service address (TCP address or absolute path for UNIX socket)")
-	origin := flag.String("origin", "", "websocket server checks Origin headers against this scheme://host[:port]")
-	logpath := flag.String("log", "", "Log file (absolute path)");
-
+// run serves until a listener fails, which it returns, or the process is
+// signalled to stop.
+func run() error {
+	cfg := newConfig()
+	cfg.flags(flag.CommandLine)
 	flag.Parse()
 
-	if strings.HasPrefix(*logpath, "/") {
-		logf, err := os.OpenFile(*logpath, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0666)
+	// Settings come from the config file (if any) overridden by flags.
+	cfg, err := loadConfig(cfg.File, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if strings.HasPrefix(cfg.Log, "/") {
+		logf, err := os.OpenFile(cfg.Log, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0666)
 		if err != nil {
 			log.Fatalf("error opening log file: %v", err)
 		}
@@ -46,55 +52,145 @@ func main() {
 	}
 
 	// Initialize metrics registry with expected stats
-	go startMetrics(metricsPort)
+	go startMetrics(cfg.MetricsPort)
 	incr("websockets", 0)    // number of connected websockets
 	incr("channels", 0)      // number of subscribed channels
 	mark("postmsgs", 0)      // rate of POST messages
 	mark("websocketmsgs", 0) // rate of WS messages
 	mark("drops", 0)         // rate of messages sent to nobody
 	mark("sends", 0)         // rate of messages sent to somebody
+	mark("publimits", 0)     // rate of publishes refused by rate limits
+	mark("connlimits", 0)    // rate of connects refused by rate limits
+	mark("connrejects", 0)   // rate of connects refused by connection caps
+	mark("slowdrops", 0)     // rate of messages skipped for slow subscribers
+	mark("originrejects", 0) // rate of websockets refused by origin checks
+	mark("webhooks", 0)      // rate of webhook events delivered
+	mark("webhookfails", 0)  // rate of webhook events failed after retries
+	mark("webhookdrops", 0)  // rate of webhook events dropped by rate limits
+	mark("filterdrops", 0)   // rate of messages dropped by filters
+	mark("ackdrops", 0)      // rate of unacked messages dropped from full cursors
+	mark("replytimeouts", 0) // rate of requests that got no reply in time
+	mark("expired", 0)       // rate of messages dropped when their TTL ran out
+	mark("dupes", 0)         // rate of duplicate messages suppressed by idempotency key
+	mark("conflated", 0)     // rate of messages replaced by newer ones for slow subscribers
+	mark("throttled", 0)     // rate of messages superseded on throttled paths
+
+	// Start the hub and reload its config on SIGHUP or file change
+	hub := newHub(cfg)
+	go hub.run()
+	go watchConfig(hub, os.Args[1:], configPollPeriod)
+
+	// Start a server on each listener
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	errc := make(chan error, len(cfg.listeners()))
+	servers := []*http.Server{}
+	for _, l := range cfg.listeners() {
+		server := &http.Server{
+			Addr:    l.Addr,
+			Handler: newHandler(hub, l),
+		}
+		servers = append(servers, server)
+		go func() {
+			errc <- serve(server)
+		}()
+	}
+	select {
+	case err = <-errc:
+		log.Printf("error serving: %v", err)
+	case sig := <-sigc:
+		log.Printf("stopping on %v", sig)
+	}
+	// Closing a server unlinks its UNIX socket.
+	for _, server := range servers {
+		server.Close()
+	}
+	return err
+}
 
-	// Start the server
-	server.Handler = newHandler(*origin)
-	http.Handle("/", server.Handler)
+// serve serves server until it fails or is closed.
+func serve(server *http.Server) error {
 	if strings.HasPrefix(server.Addr, "/") {
 		ln, err := net.Listen("unix", server.Addr)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		closeListenerOnSignals(ln)
-		server.Serve(ln)
-	} else {
-		server.ListenAndServe()
+		return server.Serve(ln)
 	}
+	return server.ListenAndServe()
 }
 
-func closeListenerOnSignals(ln net.Listener) {
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, os.Interrupt, os.Kill, syscall.SIGTERM)
-	go func(c chan os.Signal) {
-		<-c
-		ln.Close()
-		os.Exit(0)
-	}(sigc)
-}
-
-func newHandler(origin string) http.Handler {
-	hub := newHub()
-	go hub.run()
-
+// newHandler routes requests for the operations l allows and refuses the
+// others.
+func newHandler(hub *hub, l listener) http.Handler {
 	handler := mux.NewRouter()
+	allow := func(op string, h http.Handler) http.Handler {
+		if l.allows(op) {
+			return h
+		}
+		return forbidden(op)
+	}
 
 	// Route websocket requests
 	handler.NewRoute().HeadersRegexp(
 		// Requests with these headers will use this handler
 		"Connection", "[Uu]pgrade",
 		"Upgrade", "[Ww]ebsocket",
-	).Handler(newWsHandler(hub, origin))
+	).Handler(allow(opSubscribe, newWsHandler(hub)))
+
+	// Route subscriber count queries
+	handler.Methods("GET", "HEAD").MatcherFunc(hasQuery("count")).Handler(allow(opAdmin, countHandler{hub: hub}))
 
-	// Route other GET and POST requests
-	handler.Methods("GET").Handler(getHandler{hub: hub})
-	handler.Methods("POST").Handler(postHandler{hub: hub})
+	// Route other GET, POST, DELETE and CORS preflight requests
+	handler.Methods("GET").Handler(allow(opSubscribe, getHandler{hub: hub}))
+	handler.Methods("POST").Handler(allow(opPublish, postHandler{hub: hub}))
+	handler.Methods("DELETE").Handler(allow(opPublish, cancelHandler{hub: hub}))
+	handler.Methods("OPTIONS").Handler(allow(opPublish, corsHandler{hub: hub}))
 
 	return handler
 }
+
+// watchConfig reloads the hub's config file on SIGHUP or when the file
+// changes, checking every period. args are the command line flags, which
+// override the file.
+func watchConfig(h *hub, args []string, period time.Duration) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	modTime := func() time.Time {
+		if fi, err := os.Stat(h.config().File); err == nil {
+			return fi.ModTime()
+		}
+		return time.Time{}
+	}
+	lastMod := modTime()
+	for {
+		select {
+		case <-sigc:
+		case <-ticker.C:
+			if h.config().File == "" {
+				continue
+			}
+			mod := modTime()
+			if mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+		}
+		reloadConfig(h, args)
+	}
+}
+
+// reloadConfig reloads the hub's config file. An invalid file is logged
+// and the current config is kept.
+func reloadConfig(h *hub, args []string) {
+	cur := h.config()
+	next, err := loadConfig(cur.File, args)
+	if err != nil {
+		log.Printf("config reload failed, keeping current config: %v", err)
+		return
+	}
+	h.setConfig(cur.reloadable(next))
+	log.Printf("config reloaded from %q", cur.File)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// origins is a list of allowed scheme://host[:port] origins. A host may
+// start with "*." to allow any subdomain, e.g. https://*.example.com.
+type origins []string
+
+// allows reports whether origin is in the list. An empty list allows any
+// origin.
+func (o origins) allows(origin string) bool {
+	if len(o) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range o {
+		if origin == allowed {
+			return true
+		}
+		a, err := url.Parse(allowed)
+		if err != nil || a.Scheme != u.Scheme {
+			continue
+		}
+		if a.Host == u.Host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(a.Host, "*"); ok && strings.HasSuffix(u.Host, suffix) && len(u.Host) > len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate reports origins that are not scheme://host[:port].
+func (o origins) validate(fail func(format string, a ...interface{}), where string) {
+	for _, origin := range o {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			fail("%s origin %q must be scheme://host[:port]", where, origin)
+			continue
+		}
+		if strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+			fail("%s origin %q may only use a wildcard as the first label", where, origin)
+		}
+	}
+}
+
+func (o *origins) String() string {
+	return strings.Join(*o, ",")
+}
+
+// Set adds comma-separated origins.
+func (o *origins) Set(value string) error {
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			*o = append(*o, origin)
+		}
+	}
+	return nil
+}
+
+// checkOrigin reports whether r's Origin header is allowed for its path,
+// logging and counting rejections.
+func (c *config) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		if !c.RequireOrigin {
+			return true
+		}
+	} else if c.policy(r.URL.Path).origins.allows(origin) {
+		return true
+	}
+	c.rejectOrigin(r, origin)
+	return false
+}
+
+func (c *config) rejectOrigin(r *http.Request, origin string) {
+	log.Printf("origin rejected: %q for %q from %s", origin, r.URL.Path, c.remoteIP(r))
+	mark("originrejects", 1)
+}
@@ -9,22 +9,90 @@
 // Subscribe to a channel by opening a websocket to a valid path.
 //     ws://localhost:8081/Path_must_be_valid_UTF-8
 //
-// Publish by sending a plain text websocket message (valid UTF-8).
+// Publish by sending a text or binary websocket message.
 //
 // Publish by POSTing to the same path with a plain text body.
 //     curl localhost:8081/Path_must_be_valid_UTF-8 -d "Hello"
 //
+// POST bodies with a binary Content-Type (application/octet-stream,
+// application/x-protobuf, application/x-msgpack) are published as binary.
+//     curl localhost:8081/Path -H "Content-Type: application/octet-stream" --data-binary @msg.pb
+//
 // Messages are sent to all subscribers connected to the path, regardless
-// of whether they were also the sender.
+// of whether they were also the sender. Text messages are delivered in text
+// frames and binary messages in binary frames.
 //
-// Paths and messages must be valid UTF-8. Paths can be 1-256 characters.
-// Message length should be limited but it is not.
+// Paths and text messages must be valid UTF-8. Paths can be 1-256 characters.
+// Messages can be up to 64KB (-maxmsg), overridable per path pattern
+// (-maxmsgpath). Larger POST bodies are refused with 413 and larger
+// websocket frames close the connection.
 //
 // Non-websocket GET requests are served HTML with a websocket client that
 // connects to the requested path.
 //     http://localhost:8081/Path_must_be_valid_UTF-8
+//
+// Paths with presence enabled broadcast JSON join and leave events for
+// subscribers that connect with an identity (?id=name or a proxy auth
+// header). GET with a presence parameter returns the member list.
+//     curl "localhost:8081/Path_must_be_valid_UTF-8?presence"
+//
+// Subscribers can ask for only some messages with where (JSON field
+// equality) and prefix connect parameters.
+//     ws://localhost:8081/Path_must_be_valid_UTF-8?where=type=comment
+//
+// Paths with durable rules append messages to an on-disk log, even with
+// no subscribers. Subscribers can replay the log from an offset, and with
+// an envelope parameter receive each message as JSON with its offset.
+//     ws://localhost:8081/orders/1?offset=42&envelope
+//
+// Subscribers that connect with ack and a stable subscriber ID receive
+// envelopes with message IDs and acknowledge them with {"ack":id}.
+// Unacknowledged messages are redelivered when the subscriber reconnects.
+//     ws://localhost:8081/orders/1?ack&subscriber=worker-1
+//
+// Subscribers that connect with a group parameter share messages with the
+// other members of that group: each message goes to one of them.
+//     ws://localhost:8081/jobs?group=resize
+//
+// A POST with a reply parameter waits for one reply, which a subscriber
+// POSTs to the reply path given in the request's envelope.
+//     curl "localhost:8081/rpc?reply&timeout=5s" -d "ping"
+//
+// A POST with a Retain header, or an envelope with a retain field, is kept
+// for new subscribers to receive first, even with none subscribed.
+//     curl localhost:8081/Path -H "Retain: true" -d "passing"
+//
+// A POST with an Idempotency-Key header, or an envelope with a key field,
+// is not broadcast again if the channel saw the key recently.
+//     curl localhost:8081/Path -H "Idempotency-Key: 3f2a9c" -d "Hello"
+//
+// A POST with a TTL header, or an envelope with a ttl field, is not
+// delivered once that time has passed.
+//     curl localhost:8081/Path -H "TTL: 5s" -d "Hello"
+//
+// A POST with a Delay or Deliver-At header is published when it is due.
+// The response gives an ID that a DELETE to the path can cancel it with.
+//     curl localhost:8081/Path -H "Delay: 10m" -d "Hello"
+//     curl -X DELETE "localhost:8081/Path?id=9c4f1e27a0b3d865"
+//
+// GET or HEAD with a count parameter returns the number of subscribers,
+// for one path or for a list of path parameters.
+//     curl "localhost:8081/Path_must_be_valid_UTF-8?count"
+//     curl "localhost:8081/?count&path=/a&path=/b"
+//
+// Publish one message to many paths by POSTing with one or more path
+// parameters. A parameter may be a pattern (see matchPath). The response
+// reports the number of subscribers reached.
+//     curl "localhost:8081/?path=/group/1/a&path=/group/2/*" -d "Hello"
 package main
 
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// Defaults for the corresponding config settings.
 const (
 	pathLenMin = 1
 	pathLenMax = 256
@@ -35,13 +103,69 @@ const (
 	UNSUBSCRIBE = 2
 	PUBLISH     = 3
 	REMOVE      = 4
+	MULTICAST   = 5
+	PRESENCE    = 6
+	COUNT       = 7
+	MATCH       = 8
 )
 
 type queue chan command
 
 type command struct {
-	cmd  int
-	conn *connection
-	path string
-	text []byte
+	message
+	cmd      int
+	conn     *connection
+	path     string
+	paths    []string
+	reply    chan int
+	presence chan presence
+	counts   chan map[string]int
+	matches  chan []string
+
+	// A REMOVE names the channel to deregister, as a newer channel may
+	// have taken its path. One from the channel itself carries the
+	// number of subscribes it has handled and wants a reply.
+	channel    *channel
+	subscribed uint64
+	removed    chan bool
+}
+
+// message is a payload as it is delivered to subscribers.
+type message struct {
+	text    []byte
+	binary  bool
+	sender  string    // identity or IP address of the publisher
+	offset  uint64    // position in the path's durable log, or 0
+	id      uint64    // ID for ack-mode subscribers, or 0
+	replyTo string    // reply path of a request, or ""
+	expires time.Time // when the message goes stale, or zero
+	retain  bool      // keep as the path's retained message
+	key     string    // idempotency key, or ""
+}
+
+// expired reports whether msg has a TTL that ran out before now.
+func (msg message) expired(now time.Time) bool {
+	return !msg.expires.IsZero() && now.After(msg.expires)
+}
+
+// isPattern reports whether p contains any path.Match metacharacters.
+func isPattern(p string) bool {
+	return strings.ContainsAny(p, `*?[\`)
+}
+
+// matchPath reports whether p is matched by pattern, which may be a
+// literal path or a path.Match pattern. A pattern ending in "/**" also
+// matches every path below its prefix, e.g. "/user/**" matches "/user/1/a".
+func matchPath(pattern, p string) bool {
+	if !isPattern(pattern) {
+		return pattern == p
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		// Match prefix against as many leading segments of p.
+		n := strings.Count(prefix, "/")
+		segments := strings.SplitN(p, "/", n+2)
+		return len(segments) == n+2 && matchPath(prefix, strings.Join(segments[:n+1], "/"))
+	}
+	ok, err := path.Match(pattern, p)
+	return err == nil && ok
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/gorilla/websocket"
@@ -12,7 +13,9 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -39,7 +42,10 @@ func TestMain(m *testing.M) {
 	rnd = rand.New(rand.NewSource(*seed))
 	fmt.Println("TestMain: rand seed:", *seed, "(command line flag '-seed=N')")
 
-	server = httptest.NewServer(newHandler(TESTORIGIN))
+	cfg := newConfig()
+	cfg.Origins.Set(TESTORIGIN)
+	cfg.Rules.Set("/small/*=16")
+	server = httptest.NewServer(testHandler(cfg))
 	defer server.Close()
 	u, err := url.Parse(server.URL)
 	if err != nil {
@@ -50,6 +56,12 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+func testHandler(cfg *config) http.Handler {
+	h := newHub(cfg)
+	go h.run()
+	return newHandler(h, listener{})
+}
+
 func TestHTML(t *testing.T) {
 	t.Log("TestHTML: GET /somestring serves HTML containing /somestring")
 	u, _ := url.Parse(server.URL)
@@ -336,3 +348,1510 @@ func mockWs(t *testing.T, u *url.URL, c *client) (*websocket.Conn, error) {
 	ws, _, err := dialer.Dial(u.String(), requestHeader)
 	return ws, err
 }
+
+// subscribers returns the number of subscribers to u's path.
+func subscribers(t *testing.T, u *url.URL) int {
+	c := *u
+	c.Scheme = "http"
+	c.RawQuery = "count"
+	n, err := strconv.Atoi(strings.TrimSpace(string(responseBody(t, get(t, &c)))))
+	if err != nil {
+		t.Fatal("unexpected count:", err)
+	}
+	return n
+}
+
+// waitSubscribers waits until u's path has n subscribers.
+func waitSubscribers(t *testing.T, u *url.URL, n int) {
+	deadline := time.Now().Add(time.Second)
+	for subscribers(t, u) != n {
+		if time.Now().After(deadline) {
+			t.Fatal("expected", n, "subscribers to", u.Path)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// subscribe opens a websocket to u and waits until the hub has subscribed
+// it, so that messages published next reach it.
+func subscribe(t *testing.T, u *url.URL, origin string) *websocket.Conn {
+	n := subscribers(t, u)
+	ws, err := mockWs(t, u, mockClient(WS, origin))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	waitSubscribers(t, u, n+1)
+	return ws
+}
+
+func TestMulticast(t *testing.T) {
+	t.Log("TestMulticast: POST with path parameters reaches every matching channel")
+	paths := []string{"/multicast/a", "/multicast/b", "/other/c"}
+	clients := []*client{}
+	for _, path := range paths {
+		c := mockClient(WS, TESTORIGIN)
+		u, _ := url.Parse(server.URL)
+		u.Path = path
+		u.Scheme = "ws"
+		ws, err := mockWs(t, u, c)
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		c.ws = ws
+		defer c.ws.Close()
+		go c.reader()
+		c.sendSync(t, "subscribed")
+		clients = append(clients, c)
+	}
+
+	u, _ := url.Parse(server.URL)
+	u.Path = "/"
+	u.RawQuery = url.Values{"path": {"/multicast/*", "/other/c", "/nobody"}}.Encode()
+	resp := post(t, u, "hello")
+	if body := string(responseBody(t, resp)); body != "OK 3\n" {
+		t.Fatal("expected OK 3, got", body)
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, c := range clients {
+		if got := strings.Join(c.readAll(), ","); got != "subscribed,hello" {
+			t.Fatal("expected subscribed,hello got", got)
+		}
+	}
+}
+
+func TestBinary(t *testing.T) {
+	t.Log("TestBinary: binary frames and binary POST bodies arrive as binary frames")
+	c := mockClient(WS, TESTORIGIN)
+	u, _ := url.Parse(server.URL)
+	u.Path = "/binary"
+	u.Scheme = "ws"
+	ws, err := mockWs(t, u, c)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer ws.Close()
+	payload := []byte{0x00, 0xff, 0xfe, 0x80}
+	if err := ws.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+		t.Fatal("WriteMessage:", err)
+	}
+	expectFrame(t, ws, websocket.BinaryMessage, payload)
+
+	u.Scheme = "http"
+	resp, err := http.Post(u.String(), "application/octet-stream", strings.NewReader(string(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	expectFrame(t, ws, websocket.BinaryMessage, payload)
+
+	if resp := post(t, u, "\xff"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected 400 for invalid UTF-8 text, got", resp.StatusCode)
+	}
+	post(t, u, "text").Body.Close()
+	expectFrame(t, ws, websocket.TextMessage, []byte("text"))
+}
+
+func expectFrame(t *testing.T, ws *websocket.Conn, mt int, payload []byte) {
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	gotType, got, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal("ReadMessage:", err)
+	}
+	if gotType != mt || string(got) != string(payload) {
+		t.Fatal("expected frame", mt, payload, "got", gotType, got)
+	}
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	t.Log("TestMessageSizeLimit: oversized POST bodies return 413, oversized frames close the socket")
+	u, _ := url.Parse(server.URL)
+	u.Path = "/small/path"
+	resp := post(t, u, strings.Repeat("x", 17))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatal("expected 413, got", resp.Status)
+	}
+	resp = post(t, u, strings.Repeat("x", 16))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("expected 200, got", resp.Status)
+	}
+
+	c := mockClient(WS, TESTORIGIN)
+	u.Scheme = "ws"
+	ws, err := mockWs(t, u, c)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer ws.Close()
+	ws.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 17)))
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatal("expected close 1009, got", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Log("TestRateLimit: POSTs over the publish limit get 429, websockets get a close code")
+	cfg := newConfig()
+	cfg.PublishLimit.Set("path=0.01:2")
+	limited := httptest.NewServer(testHandler(cfg))
+	defer limited.Close()
+
+	u, _ := url.Parse(limited.URL)
+	u.Path = "/limited/post"
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp := post(t, u, "hello")
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatal("POST", i, "expected", want, "got", resp.Status)
+		}
+	}
+
+	// A request denied by a rule's limit, including for a multicast
+	// target, leaves the global IP limit alone.
+	cfg = newConfig()
+	cfg.PublishLimit.Set("ip=0.01:2")
+	cfg.Rules = rules{{Pattern: "/limited/rule"}}
+	cfg.Rules[0].PublishLimit.Set("path=0.01:1")
+	ruled := httptest.NewServer(testHandler(cfg))
+	defer ruled.Close()
+	for i, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/limited/rule", http.StatusOK},
+		{"/limited/rule", http.StatusTooManyRequests},
+		{"/?path=/limited/rule", http.StatusTooManyRequests},
+		{"/limited/other", http.StatusOK},
+		{"/limited/other", http.StatusTooManyRequests},
+	} {
+		r, _ := url.Parse(ruled.URL + tc.path)
+		resp := post(t, r, "hello")
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Fatal("POST", i, tc.path, "expected", tc.want, "got", resp.Status)
+		}
+	}
+
+	// A multicast charges the IP once and each path it reaches once,
+	// whatever pattern reached it.
+	cfg = newConfig()
+	cfg.PublishLimit.Set("ip=0.01:2,path=0.01:1")
+	fanned := httptest.NewServer(testHandler(cfg))
+	defer fanned.Close()
+	for _, path := range []string{"/fan/a", "/fan/b", "/fan/c"} {
+		f, _ := url.Parse(fanned.URL + path)
+		f.Scheme = "ws"
+		ws := subscribe(t, f, "")
+		defer ws.Close()
+	}
+	for i, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/?path=/fan/*", http.StatusOK},
+		{"/?path=/fan/**", http.StatusTooManyRequests},
+		{"/fan/d", http.StatusOK},
+	} {
+		r, _ := url.Parse(fanned.URL + tc.path)
+		resp := post(t, r, "hello")
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Fatal("POST", i, tc.path, "expected", tc.want, "got", resp.Status)
+		}
+	}
+
+	u.Path = "/limited/ws"
+	u.Scheme = "ws"
+	ws, err := mockWs(t, u, mockClient(WS, ""))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 3; i++ {
+		ws.WriteMessage(websocket.TextMessage, []byte("hello"))
+	}
+	for {
+		_, _, err = ws.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Fatal("expected close 1013, got", err)
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	t.Log("TestConnectionLimits: websockets over a subscriber cap are refused before upgrading")
+	cfg := newConfig()
+	cfg.MaxSubscribers = 1
+	limited := httptest.NewServer(testHandler(cfg))
+	defer limited.Close()
+
+	u, _ := url.Parse(limited.URL)
+	u.Path = "/capped"
+	u.Scheme = "ws"
+	ws, err := mockWs(t, u, mockClient(WS, ""))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer ws.Close()
+	if _, err := mockWs(t, u, mockClient(WS, "")); err == nil {
+		t.Fatal("second subscriber was not refused")
+	}
+	u.Path = "/capped/other"
+	other, err := mockWs(t, u, mockClient(WS, ""))
+	if err != nil {
+		t.Fatal("dial error on another path:", err)
+	}
+	other.Close()
+}
+
+func TestConfigFile(t *testing.T) {
+	t.Log("TestConfigFile: a JSON config file is loaded, overridden by flags and validated")
+	file := t.TempDir() + "/pinghub.json"
+	err := ioutil.WriteFile(file, []byte(`{
+		"MaxMessageSize": 1024,
+		"PongWait": "1m",
+		"WriteWait": 5,
+		"Rules": [{"Pattern": "/big/*", "MaxMessageSize": 1048576}],
+		"PublishLimit": {"IP": {"Rate": 10, "Burst": 20}}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(file, []string{"-maxmsg", "2048"})
+	if err != nil {
+		t.Fatal("loadConfig:", err)
+	}
+	if cfg.MaxMessageSize != 2048 || cfg.messageLimit("/big/x") != 1048576 {
+		t.Fatal("unexpected message limits:", cfg.MaxMessageSize, cfg.Rules)
+	}
+	if cfg.PongWait.Duration != time.Minute || cfg.WriteWait.Duration != 5*time.Second {
+		t.Fatal("unexpected timeouts:", cfg.PongWait, cfg.WriteWait)
+	}
+	if cfg.PublishLimit.IP != (rateSpec{Rate: 10, Burst: 20}) {
+		t.Fatal("unexpected publish limit:", cfg.PublishLimit)
+	}
+	cfg, err = loadConfig(file, []string{"-maxmsgpath", "/big/*=4096"})
+	if err != nil {
+		t.Fatal("loadConfig:", err)
+	}
+	if cfg.messageLimit("/big/x") != 4096 {
+		t.Fatal("expected the flag rule to take precedence over the file's:", cfg.Rules)
+	}
+
+	ioutil.WriteFile(file, []byte(`{"MaxMessageSize": 0, "Origins": ["example.com"]}`), 0600)
+	if _, err := loadConfig(file, nil); err == nil ||
+		!strings.Contains(err.Error(), "MaxMessageSize") || !strings.Contains(err.Error(), "example.com") {
+		t.Fatal("expected validation errors, got", err)
+	}
+	ioutil.WriteFile(file, []byte(`{"MaxMesageSize": 10}`), 0600)
+	if _, err := loadConfig(file, nil); err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	t.Log("TestConfigReload: a changed config file is reloaded and its limits and rules take effect")
+	file := t.TempDir() + "/pinghub.json"
+	write := func(config string) {
+		if err := ioutil.WriteFile(file, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"Rules": [{"Pattern": "/reload/*", "MaxMessageSize": 16}]}`)
+	cfg, err := loadConfig(file, nil)
+	if err != nil {
+		t.Fatal("loadConfig:", err)
+	}
+	h := newHub(cfg)
+	go h.run()
+	go watchConfig(h, nil, 10*time.Millisecond)
+	reloaded := httptest.NewServer(newHandler(h, listener{}))
+	defer reloaded.Close()
+	u, _ := url.Parse(reloaded.URL)
+	u.Path = "/reload/x"
+	status := func() int {
+		resp := post(t, u, strings.Repeat("x", 17))
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := status(); got != http.StatusRequestEntityTooLarge {
+		t.Fatal("expected 413 before reloading, got", got)
+	}
+
+	write(`{
+		"Rules": [{"Pattern": "/reload/*", "MaxMessageSize": 32}],
+		"PublishLimit": {"Path": {"Rate": 0.01, "Burst": 1}}
+	}`)
+	deadline := time.Now().Add(2 * time.Second)
+	for status() != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("the new rule did not take effect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := status(); got != http.StatusTooManyRequests {
+		t.Fatal("expected the new publish limit to give 429, got", got)
+	}
+}
+
+func TestRules(t *testing.T) {
+	t.Log("TestRules: the first matching rule that sets a policy wins and channels apply it")
+	no := false
+	cfg := newConfig()
+	cfg.Rules = rules{
+		{Pattern: "/feed/*", History: 2, ClientPublish: &no},
+		{Pattern: "/feed/*", MaxMessageSize: 5, History: 10},
+		{Pattern: "/**", SlowConsumer: slowDrop},
+	}
+	p := cfg.policy("/feed/x")
+	if p.history != 2 || p.clientPublish || p.maxMessageSize != 5 || p.slowConsumer != slowDrop {
+		t.Fatal("unexpected policy for /feed/x:", p)
+	}
+	p = cfg.policy("/other/x")
+	if p.history != 0 || !p.clientPublish || p.maxMessageSize != cfg.MaxMessageSize || p.slowConsumer != slowDrop {
+		t.Fatal("unexpected policy for /other/x:", p)
+	}
+	if !matchPath("/user/*/chan/**", "/user/1/chan/a/b") || matchPath("/user/*/chan/**", "/user/1/other/a") {
+		t.Fatal("unexpected /** pattern match")
+	}
+
+	ruled := httptest.NewServer(testHandler(cfg))
+	defer ruled.Close()
+	u, _ := url.Parse(ruled.URL)
+	u.Path = "/feed/x"
+	u.Scheme = "ws"
+	first, err := mockWs(t, u, mockClient(WS, ""))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer first.Close()
+	time.Sleep(50 * time.Millisecond)
+	u.Scheme = "http"
+	for _, m := range []string{"one", "two", "three"} {
+		post(t, u, m).Body.Close()
+	}
+	expectFrame(t, first, websocket.TextMessage, []byte("one"))
+
+	u.Scheme = "ws"
+	second, err := mockWs(t, u, mockClient(WS, ""))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer second.Close()
+	expectFrame(t, second, websocket.TextMessage, []byte("two"))
+	expectFrame(t, second, websocket.TextMessage, []byte("three"))
+
+	second.WriteMessage(websocket.TextMessage, []byte("hi"))
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := second.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatal("expected close 1008 for a client publish, got", err)
+	}
+}
+
+func TestListenerOps(t *testing.T) {
+	t.Log("TestListenerOps: a listener refuses operations it does not allow")
+	h := newHub(newConfig())
+	go h.run()
+	internal := httptest.NewServer(newHandler(h, listener{Ops: []string{opPublish}}))
+	defer internal.Close()
+
+	u, _ := url.Parse(internal.URL)
+	u.Path = "/internal"
+	resp := post(t, u, "hello")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("expected POST to be allowed, got", resp.Status)
+	}
+	resp = get(t, u)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatal("expected GET to be forbidden, got", resp.Status)
+	}
+	u.Scheme = "ws"
+	if _, err := mockWs(t, u, mockClient(WS, "")); err == nil {
+		t.Fatal("expected websocket to be forbidden")
+	}
+}
+
+func TestOrigins(t *testing.T) {
+	t.Log("TestOrigins: origin lists allow exact and wildcard subdomain origins per path")
+	cfg := newConfig()
+	cfg.Origins.Set("https://example.com,https://*.example.org")
+	cfg.Rules = rules{{Pattern: "/partner/**", Origins: origins{"https://partner.example.net"}}}
+	cfg.RequireOrigin = true
+	for _, tc := range []struct {
+		path, origin string
+		ok           bool
+	}{
+		{"/a", "https://example.com", true},
+		{"/a", "https://www.example.org", true},
+		{"/a", "https://a.b.example.org", true},
+		{"/a", "https://example.org", false},
+		{"/a", "http://www.example.org", false},
+		{"/a", "https://evilexample.org", false},
+		{"/a", "", false},
+		{"/partner/x", "https://partner.example.net", true},
+		{"/partner/x", "https://example.com", false},
+	} {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := cfg.checkOrigin(r); got != tc.ok {
+			t.Fatal("checkOrigin", tc.path, tc.origin, "expected", tc.ok, "got", got)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	t.Log("TestCORS: preflights and POSTs from allowed origins get CORS headers")
+	cfg := newConfig()
+	cfg.Origins.Set("https://*.example.com")
+	cfg.CORS = true
+	cfg.Rules = rules{{Pattern: "/restricted/*"}}
+	cfg.Rules[0].Origins.Set("https://admin.example.org")
+	cors := httptest.NewServer(testHandler(cfg))
+	defer cors.Close()
+
+	requestPath := func(method, path, origin string) *http.Response {
+		req, _ := http.NewRequest(method, cors.URL+path, strings.NewReader("hello"))
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	request := func(method, origin string) *http.Response {
+		return requestPath(method, "/cors", origin)
+	}
+	resp := request("OPTIONS", "https://www.example.com")
+	if resp.StatusCode != http.StatusNoContent ||
+		resp.Header.Get("Access-Control-Allow-Origin") != "https://www.example.com" ||
+		resp.Header.Get("Access-Control-Allow-Methods") != "POST, DELETE" ||
+		resp.Header.Get("Access-Control-Allow-Headers") != "Content-Type" {
+		t.Fatal("unexpected preflight response:", resp.Status, resp.Header)
+	}
+	if resp = request("OPTIONS", "https://evil.example.net"); resp.StatusCode != http.StatusForbidden {
+		t.Fatal("expected preflight from a bad origin to be forbidden, got", resp.Status)
+	}
+	resp = request("POST", "https://www.example.com")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "https://www.example.com" {
+		t.Fatal("unexpected POST response:", resp.Status, resp.Header)
+	}
+	if resp = request("POST", "https://evil.example.net"); resp.StatusCode != http.StatusForbidden {
+		t.Fatal("expected POST from a bad origin to be forbidden, got", resp.Status)
+	}
+	if resp = requestPath("POST", "/?path=/cors&path=/restricted/x", "https://www.example.com"); resp.StatusCode != http.StatusForbidden {
+		t.Fatal("expected a multicast to a path refusing the origin to be forbidden, got", resp.Status)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	t.Log("TestPresence: members joining and leaving are announced and listed")
+	cfg := newConfig()
+	cfg.Rules = rules{{Pattern: "/room/**", Presence: true}}
+	rooms := httptest.NewServer(testHandler(cfg))
+	defer rooms.Close()
+
+	dial := func(id string) *websocket.Conn {
+		u, _ := url.Parse(rooms.URL)
+		u.Path = "/room/1"
+		u.RawQuery = "id=" + id
+		u.Scheme = "ws"
+		ws, err := mockWs(t, u, mockClient(WS, ""))
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		return ws
+	}
+	alice := dial("alice")
+	defer alice.Close()
+	bob := dial("bob")
+	expectFrame(t, alice, websocket.TextMessage, []byte(`{"presence":"join","id":"bob","count":2}`))
+
+	resp, err := http.Get(rooms.URL + "/room/1?presence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := string(responseBody(t, resp)); body != `{"path":"/room/1","count":2,"members":["alice","bob"]}`+"\n" {
+		t.Fatal("unexpected presence:", body)
+	}
+
+	bob.Close()
+	expectFrame(t, alice, websocket.TextMessage, []byte(`{"presence":"leave","id":"bob","count":1}`))
+
+	resp, err = http.Get(rooms.URL + "/lobby?presence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("expected 404 for a path without presence, got", resp.Status)
+	}
+}
+
+func TestCount(t *testing.T) {
+	t.Log("TestCount: count queries report subscribers without creating channels")
+	c := mockClient(WS, TESTORIGIN)
+	u, _ := url.Parse(server.URL)
+	u.Path = "/counted"
+	u.Scheme = "ws"
+	ws, err := mockWs(t, u, c)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer ws.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	resp, err := http.Get(server.URL + "/counted?count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := string(responseBody(t, resp)); body != "1\n" || resp.Header.Get("X-Subscribers") != "1" {
+		t.Fatal("unexpected count:", body, resp.Header)
+	}
+	resp, err = http.Head(server.URL + "/uncounted?count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Subscribers") != "0" {
+		t.Fatal("unexpected HEAD count:", resp.Header)
+	}
+	resp, err = http.Get(server.URL + "/?count&path=/counted&path=/uncounted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := string(responseBody(t, resp)); body != `{"/counted":1,"/uncounted":0}`+"\n" {
+		t.Fatal("unexpected bulk count:", body)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	t.Log("TestWebhooks: channel create and remove events are POSTed in order and retried")
+	events := make(chan webhookEvent, 10)
+	failures := 1
+	var mu sync.Mutex
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "try again", http.StatusInternalServerError)
+			return
+		}
+		var e webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error("webhook body:", err)
+		}
+		events <- e
+	}))
+	defer stub.Close()
+
+	cfg := newConfig()
+	cfg.Node = "node1"
+	cfg.Webhooks = webhooks{{
+		Pattern:      "/hooked/**",
+		URL:          stub.URL,
+		Retries:      2,
+		RetryBackoff: duration{10 * time.Millisecond},
+	}}
+	hooked := httptest.NewServer(testHandler(cfg))
+	defer hooked.Close()
+
+	u, _ := url.Parse(hooked.URL)
+	u.Path = "/hooked/live"
+	u.Scheme = "ws"
+	ws, err := mockWs(t, u, mockClient(WS, ""))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	expectEvent := func(event string) {
+		select {
+		case e := <-events:
+			if e.Event != event || e.Path != "/hooked/live" || e.Node != "node1" || e.Timestamp.IsZero() {
+				t.Fatal("unexpected webhook event:", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no webhook event", event)
+		}
+	}
+	// The remove waits for the create's retry.
+	ws.Close()
+	expectEvent(eventCreate)
+	expectEvent(eventRemove)
+
+	// Webhooks sharing a URL each keep their own retry settings.
+	gate := make(chan struct{})
+	calls := 0
+	shared := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		n := calls
+		mu.Unlock()
+		switch n {
+		case 1:
+			<-gate
+		case 2:
+			http.Error(w, "try again", http.StatusInternalServerError)
+		default:
+			var e webhookEvent
+			json.NewDecoder(r.Body).Decode(&e)
+			events <- e
+		}
+	}))
+	defer shared.Close()
+	q := &webhookQueue{}
+	q.push(&webhook{URL: shared.URL}, webhookEvent{Event: eventCreate, Path: "/first"})
+	q.push(&webhook{URL: shared.URL, Retries: 1, RetryBackoff: duration{time.Millisecond}}, webhookEvent{Event: eventCreate, Path: "/second"})
+	close(gate)
+	select {
+	case e := <-events:
+		if e.Path != "/second" {
+			t.Fatal("unexpected webhook event:", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the second webhook's event to be retried")
+	}
+}
+
+func TestFilters(t *testing.T) {
+	t.Log("TestFilters: built-in filters validate, rewrite and drop messages")
+	var fcs []filterConfig
+	err := json.Unmarshal([]byte(`[
+		{"Name": "size", "Args": {"Max": 100}},
+		{"Name": "regexdrop", "Args": {"Pattern": "spam"}},
+		{"Name": "jsonschema", "Args": {"Schema": {
+			"Type": "object",
+			"Required": ["type"],
+			"Properties": {"type": {"Type": "string"}, "n": {"Type": "integer"}}
+		}}},
+		{"Name": "strip", "Args": {"Fields": ["secret"]}},
+		{"Name": "sender"}
+	]`), &fcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := newFilterChain(fcs)
+	if err != nil {
+		t.Fatal("newFilterChain:", err)
+	}
+	for _, tc := range []struct {
+		in, out string
+		ok      bool
+	}{
+		{`{"type":"comment","secret":"x"}`, `{"sender":"alice","type":"comment"}`, true},
+		{`{"type":"comment","n":1.5}`, "", false},
+		{`{"n":1}`, "", false},
+		{`not json`, "", false},
+		{`{"type":"spam"}`, "", false},
+		{`{"type":"` + strings.Repeat("x", 100) + `"}`, "", false},
+	} {
+		msg, ok := chain.apply(message{text: []byte(tc.in), sender: "alice"})
+		if ok != tc.ok || (ok && string(msg.text) != tc.out) {
+			t.Fatal("filter", tc.in, "expected", tc.ok, tc.out, "got", ok, string(msg.text))
+		}
+	}
+	if _, err := newFilterChain([]filterConfig{{Name: "nosuchfilter"}}); err == nil {
+		t.Fatal("expected an error for an unknown filter")
+	}
+	if _, err := newFilterChain([]filterConfig{{Name: "regexdrop"}}); err == nil {
+		t.Fatal("expected an error for a regexdrop filter without a Pattern")
+	}
+
+	cfg := newConfig()
+	cfg.Rules = rules{{Pattern: "/filtered", Filters: []filterConfig{{Name: "regexdrop", Args: json.RawMessage(`{"Pattern":"^drop"}`)}}}}
+	filtered := httptest.NewServer(testHandler(cfg))
+	defer filtered.Close()
+	u, _ := url.Parse(filtered.URL)
+	u.Path = "/filtered"
+	u.Scheme = "ws"
+	ws, err := mockWs(t, u, mockClient(WS, ""))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer ws.Close()
+	ws.WriteMessage(websocket.TextMessage, []byte("drop me"))
+	ws.WriteMessage(websocket.TextMessage, []byte("keep me"))
+	expectFrame(t, ws, websocket.TextMessage, []byte("keep me"))
+}
+
+func TestSubscriberFilter(t *testing.T) {
+	t.Log("TestSubscriberFilter: subscribers receive only messages matching their filter")
+	dial := func(query string) *websocket.Conn {
+		u, _ := url.Parse(server.URL)
+		u.Path = "/subfilter"
+		u.RawQuery = query
+		u.Scheme = "ws"
+		ws, err := mockWs(t, u, mockClient(WS, TESTORIGIN))
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		return ws
+	}
+	comments := dial("where=type=comment&where=post.id=157")
+	defer comments.Close()
+	prefixed := dial("prefix=" + url.QueryEscape(`{"type":"like"`))
+	defer prefixed.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	u, _ := url.Parse(server.URL)
+	u.Path = "/subfilter"
+	for _, m := range []string{
+		`{"type":"like","post":{"id":157}}`,
+		`{"type":"comment","post":{"id":158}}`,
+		`{"type":"comment","post":{"id":157}}`,
+	} {
+		post(t, u, m).Body.Close()
+	}
+	expectFrame(t, comments, websocket.TextMessage, []byte(`{"type":"comment","post":{"id":157}}`))
+	expectFrame(t, prefixed, websocket.TextMessage, []byte(`{"type":"like","post":{"id":157}}`))
+	prefixed.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, got, err := prefixed.ReadMessage(); err == nil {
+		t.Fatal("unexpected message for prefix filter:", string(got))
+	}
+
+	u.Scheme = "ws"
+	u.RawQuery = "where=nofield"
+	if _, err := mockWs(t, u, mockClient(WS, TESTORIGIN)); err == nil {
+		t.Fatal("expected a bad filter to be refused")
+	}
+}
+
+func TestDurable(t *testing.T) {
+	t.Log("TestDurable: durable paths log messages without subscribers, survive a restart and replay from an offset")
+	dir := t.TempDir()
+	// Each server gets its own config, which its hub owns.
+	durableConfig := func() *config {
+		cfg := newConfig()
+		cfg.Durability.Dir = dir
+		cfg.Durability.Fsync = fsyncAlways
+		cfg.Rules = rules{{Pattern: "/orders/**", Durable: true, History: 3}}
+		return cfg
+	}
+
+	first := httptest.NewServer(testHandler(durableConfig()))
+	u, _ := url.Parse(first.URL)
+	u.Path = "/orders/1"
+	for _, m := range []struct{ text, header, value string }{
+		{"one", "Idempotency-Key", "k1"},
+		{"two", "Retain", "true"},
+		{"stale", "TTL", "100ms"},
+		{"three", "", ""},
+	} {
+		req, _ := http.NewRequest("POST", u.String(), strings.NewReader(m.text))
+		if m.header != "" {
+			req.Header.Set(m.header, m.value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// Let the stale message expire.
+	time.Sleep(150 * time.Millisecond)
+	first.Close()
+
+	// Tear the end of the log as a crash would.
+	segs, _ := filepath.Glob(filepath.Join(dir, "*", "*.seg"))
+	if len(segs) != 1 {
+		t.Fatal("expected one segment file, got", segs)
+	}
+	f, err := os.OpenFile(segs[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0})
+	f.Close()
+
+	restarted := httptest.NewServer(testHandler(durableConfig()))
+	defer restarted.Close()
+	u, _ = url.Parse(restarted.URL)
+	u.Path = "/orders/1"
+	u.Scheme = "ws"
+	recent, err := mockWs(t, u, mockClient(WS, ""))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer recent.Close()
+	expectFrame(t, recent, websocket.TextMessage, []byte("two"))
+	expectFrame(t, recent, websocket.TextMessage, []byte("three"))
+
+	u.RawQuery = "offset=1&envelope"
+	replayed, err := mockWs(t, u, mockClient(WS, ""))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer replayed.Close()
+	for _, env := range []string{
+		`{"offset":1,"key":"k1","text":"one"}`,
+		`{"offset":2,"retain":true,"text":"two"}`,
+		`{"offset":4,"text":"three"}`,
+	} {
+		expectFrame(t, replayed, websocket.TextMessage, []byte(env))
+	}
+	u.Scheme = "http"
+	u.RawQuery = ""
+	post(t, u, "four").Body.Close()
+	expectFrame(t, replayed, websocket.TextMessage, []byte(`{"offset":5,"text":"four"}`))
+
+	u.Scheme = "ws"
+	u.RawQuery = "offset=last"
+	if _, err := mockWs(t, u, mockClient(WS, "")); err == nil {
+		t.Fatal("expected a bad offset to be refused")
+	}
+}
+
+func TestAck(t *testing.T) {
+	t.Log("TestAck: unacknowledged messages are redelivered when an ack-mode subscriber reconnects")
+	u, _ := url.Parse(server.URL)
+	u.Path = "/ack"
+	u.Scheme = "ws"
+	subscriber := fmt.Sprint("worker", rnd.Int63())
+	u.RawQuery = "ack&subscriber=" + subscriber
+	read := func(ws *websocket.Conn) envelope {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var env envelope
+		if err := ws.ReadJSON(&env); err != nil {
+			t.Fatal("read error:", err)
+		}
+		return env
+	}
+	ws := subscribe(t, u, TESTORIGIN)
+	u.Scheme = "http"
+	u.RawQuery = ""
+	post(t, u, "one").Body.Close()
+	post(t, u, "two").Body.Close()
+	one, two := read(ws), read(ws)
+	if one.Text != "one" || two.Text != "two" || one.ID == 0 || two.ID <= one.ID {
+		t.Fatal("unexpected envelopes:", one, two)
+	}
+	ws.WriteJSON(map[string]uint64{"ack": one.ID})
+	ws.Close()
+	waitSubscribers(t, u, 0)
+	post(t, u, "three").Body.Close()
+
+	u.Scheme = "ws"
+	u.RawQuery = "ack&subscriber=" + subscriber
+	ws, err := mockWs(t, u, mockClient(WS, TESTORIGIN))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer ws.Close()
+	if env := read(ws); env.ID != two.ID || env.Text != "two" {
+		t.Fatal("expected redelivery of", two, "got", env)
+	}
+	if env := read(ws); env.Text != "three" {
+		t.Fatal("expected the message published while away, got", env)
+	}
+
+	u.RawQuery = "ack"
+	if _, err := mockWs(t, u, mockClient(WS, TESTORIGIN)); err == nil {
+		t.Fatal("expected ack without a subscriber ID to be refused")
+	}
+	u.RawQuery = "ack&subscriber=" + subscriber + "&offset=0"
+	if _, err := mockWs(t, u, mockClient(WS, TESTORIGIN)); err == nil {
+		t.Fatal("expected ack with an offset to be refused")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	t.Log("TestGroups: each message goes to one member of a group and to every ordinary subscriber")
+	u, _ := url.Parse(server.URL)
+	u.Path = "/groups"
+	u.Scheme = "ws"
+	dial := func(query string) *websocket.Conn {
+		u.RawQuery = query
+		return subscribe(t, u, TESTORIGIN)
+	}
+	everyone := dial("")
+	defer everyone.Close()
+	workers := []*websocket.Conn{dial("group=workers"), dial("group=workers")}
+	for _, ws := range workers {
+		defer ws.Close()
+	}
+
+	u.Scheme = "http"
+	u.RawQuery = ""
+	messages := []string{"one", "two", "three", "four"}
+	for _, m := range messages {
+		post(t, u, m).Body.Close()
+	}
+	for _, m := range messages {
+		expectFrame(t, everyone, websocket.TextMessage, []byte(m))
+	}
+	got := map[string]int{}
+	for i, ws := range workers {
+		for {
+			ws.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, m, err := ws.ReadMessage()
+			if err != nil {
+				break
+			}
+			got[string(m)]++
+			got[fmt.Sprint("worker", i)]++
+		}
+	}
+	for _, m := range messages {
+		if got[m] != 1 {
+			t.Fatalf("expected %q once in the group, got %v", m, got)
+		}
+	}
+	if got["worker0"] != 2 || got["worker1"] != 2 {
+		t.Fatal("expected round-robin across the group, got", got)
+	}
+
+	u.Scheme = "ws"
+	u.RawQuery = "group="
+	if _, err := mockWs(t, u, mockClient(WS, TESTORIGIN)); err == nil {
+		t.Fatal("expected an empty group name to be refused")
+	}
+	u.RawQuery = "group=workers&ack&subscriber=w"
+	if _, err := mockWs(t, u, mockClient(WS, TESTORIGIN)); err == nil {
+		t.Fatal("expected a group member with ack to be refused")
+	}
+	u.RawQuery = "group=workers&offset=0"
+	if _, err := mockWs(t, u, mockClient(WS, TESTORIGIN)); err == nil {
+		t.Fatal("expected a group member with an offset to be refused")
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	t.Log("TestRequestReply: a POST with reply waits for a subscriber to POST to its reply path")
+	u, _ := url.Parse(server.URL)
+	u.Path = "/rpc"
+	u.Scheme = "ws"
+	responder := subscribe(t, u, TESTORIGIN)
+	defer responder.Close()
+	go func() {
+		var req envelope
+		if err := responder.ReadJSON(&req); err != nil || req.Text != "ping" {
+			return
+		}
+		r, _ := url.Parse(server.URL)
+		r.Path = req.Reply
+		if resp, err := http.Post(r.String(), "text/plain", strings.NewReader("pong")); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	u.Scheme = "http"
+	u.RawQuery = "reply&timeout=2s"
+	resp := post(t, u, "ping")
+	if body := string(responseBody(t, resp)); resp.StatusCode != http.StatusOK || body != "pong" {
+		t.Fatal("expected reply pong, got", resp.StatusCode, body)
+	}
+
+	// The responder ignores this one.
+	u.RawQuery = "reply&timeout=100ms"
+	if resp := post(t, u, "ping"); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatal("expected 504 for an unanswered request, got", resp.StatusCode)
+	}
+	keyed := func(key string) *http.Response {
+		req, _ := http.NewRequest("POST", u.String(), strings.NewReader("ping"))
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	keyed("rpc-1")
+	if resp := keyed("rpc-1"); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatal("expected 422 for a duplicate request, got", resp.StatusCode)
+	}
+
+	// A request with no subscribers is not kept for later ones.
+	u.Path = "/rpc/nobody"
+	req, _ := http.NewRequest("POST", u.String(), strings.NewReader("ping"))
+	req.Header.Set("Retain", "true")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("expected 503 for a request with no subscribers, got", resp.StatusCode)
+	}
+	u.Scheme = "ws"
+	u.RawQuery = ""
+	later := subscribe(t, u, TESTORIGIN)
+	defer later.Close()
+	later.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, got, err := later.ReadMessage(); err == nil {
+		t.Fatal("expected a request with no subscribers not to be retained, got", string(got))
+	}
+
+	u.Path = replyPrefix + "x"
+	if _, err := mockWs(t, u, mockClient(WS, TESTORIGIN)); err == nil {
+		t.Fatal("expected reply paths to refuse subscribers")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	t.Log("TestSchedule: delayed POSTs are delivered when due unless cancelled, and survive a restart")
+	u, _ := url.Parse(server.URL)
+	u.Path = "/later"
+	u.Scheme = "ws"
+	ws := subscribe(t, u, TESTORIGIN)
+	defer ws.Close()
+
+	u.Scheme = "http"
+	schedule := func(body, header, value string) (int, string) {
+		req, _ := http.NewRequest("POST", u.String(), strings.NewReader(body))
+		req.Header.Set(header, value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, strings.TrimSpace(strings.TrimPrefix(string(responseBody(t, resp)), "OK "))
+	}
+	start := time.Now()
+	if status, _ := schedule("soon", "Delay", "200ms"); status != http.StatusAccepted {
+		t.Fatal("expected 202 for a delayed message, got", status)
+	}
+	status, id := schedule("cancelled", "Deliver-At", time.Now().Add(300*time.Millisecond).Format(time.RFC3339Nano))
+	if status != http.StatusAccepted || id == "" {
+		t.Fatal("expected 202 and an ID, got", status, id)
+	}
+	cancel := func() int {
+		req, _ := http.NewRequest("DELETE", u.String()+"?id="+id, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := cancel(); status != http.StatusNoContent {
+		t.Fatal("expected 204 cancelling a scheduled message, got", status)
+	}
+	if status := cancel(); status != http.StatusNotFound {
+		t.Fatal("expected 404 cancelling it again, got", status)
+	}
+	expectFrame(t, ws, websocket.TextMessage, []byte("soon"))
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatal("message delivered before it was due, after", elapsed)
+	}
+	ws.SetReadDeadline(time.Now().Add(400 * time.Millisecond))
+	if _, got, err := ws.ReadMessage(); err == nil {
+		t.Fatal("cancelled message delivered:", string(got))
+	}
+	if status, _ := schedule("bad", "Delay", "soon"); status != http.StatusBadRequest {
+		t.Fatal("expected 400 for a bad Delay, got", status)
+	}
+
+	file := filepath.Join(t.TempDir(), "schedule.json")
+	saved := newScheduler(make(queue, 1), file)
+	saved.add("/later", message{text: []byte("saved")}, time.Now().Add(time.Hour), 0, 10)
+	gone, _ := saved.add("/later", message{text: []byte("gone")}, time.Now().Add(time.Hour), 0, 10)
+	saved.cancel("/later", gone)
+	if loaded := newScheduler(make(queue, 1), file); len(loaded.due) != 1 || string(loaded.due[0].Text) != "saved" {
+		t.Fatal("expected the scheduled message to be loaded from", file)
+	}
+	for i := 0; i < compactEntries; i++ {
+		id, _ := saved.add("/later", message{text: []byte("gone")}, time.Now().Add(time.Hour), 0, 10)
+		saved.cancel("/later", id)
+	}
+	if saved.entries > 1+compactEntries {
+		t.Fatal("expected the journal to be compacted, has", saved.entries, "entries")
+	}
+	if loaded := newScheduler(make(queue, 1), file); len(loaded.due) != 1 {
+		t.Fatal("expected one scheduled message after compaction, got", len(loaded.due))
+	}
+}
+
+func TestTTL(t *testing.T) {
+	t.Log("TestTTL: messages past their TTL are not delivered or kept in history")
+	cfg := newConfig()
+	cfg.Rules = rules{{Pattern: "/ttl", History: 5}}
+	ttlServer := httptest.NewServer(testHandler(cfg))
+	defer ttlServer.Close()
+	u, _ := url.Parse(ttlServer.URL)
+	u.Path = "/ttl"
+	u.Scheme = "ws"
+	u.RawQuery = "envelope"
+	first := subscribe(t, u, "")
+	defer first.Close()
+
+	u.Scheme = "http"
+	u.RawQuery = ""
+	publish := func(body, ttl string) int {
+		req, _ := http.NewRequest("POST", u.String(), strings.NewReader(body))
+		req.Header.Set("TTL", ttl)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	publish("gone", "1ns")
+	first.WriteJSON(map[string]string{"text": "gone too", "ttl": "1ns"})
+	publish("stale", "100ms")
+	publish("fresh", "")
+	expectFrame(t, first, websocket.TextMessage, []byte(`{"text":"stale"}`))
+	expectFrame(t, first, websocket.TextMessage, []byte(`{"text":"fresh"}`))
+	if status := publish("bad", "soon"); status != http.StatusBadRequest {
+		t.Fatal("expected 400 for a bad TTL, got", status)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	u.Scheme = "ws"
+	second, err := mockWs(t, u, mockClient(WS, ""))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer second.Close()
+	expectFrame(t, second, websocket.TextMessage, []byte("fresh"))
+}
+
+func TestRetain(t *testing.T) {
+	t.Log("TestRetain: new subscribers first get the path's last retained message, kept without subscribers")
+	u, _ := url.Parse(server.URL)
+	u.Path = "/score"
+	publish := func(body, retain string) int {
+		req, _ := http.NewRequest("POST", u.String(), strings.NewReader(body))
+		req.Header.Set("Retain", retain)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	publish("1-0", "true")
+	publish("2-0", "true")
+	publish("chatter", "")
+
+	u.Scheme = "ws"
+	ws, err := mockWs(t, u, mockClient(WS, TESTORIGIN))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer ws.Close()
+	expectFrame(t, ws, websocket.TextMessage, []byte("2-0"))
+	u.RawQuery = "envelope"
+	env, err := mockWs(t, u, mockClient(WS, TESTORIGIN))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer env.Close()
+	expectFrame(t, env, websocket.TextMessage, []byte(`{"retain":true,"text":"2-0"}`))
+
+	u.Scheme = "http"
+	u.RawQuery = ""
+	if status := publish("", "true"); status != http.StatusOK {
+		t.Fatal("expected an empty retained message to clear, got", status)
+	}
+	if status := publish("x", "maybe"); status != http.StatusBadRequest {
+		t.Fatal("expected 400 for a bad Retain header, got", status)
+	}
+	u.Scheme = "ws"
+	cleared, err := mockWs(t, u, mockClient(WS, TESTORIGIN))
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer cleared.Close()
+	cleared.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, got, err := cleared.ReadMessage(); err == nil {
+		t.Fatal("unexpected message after clearing:", string(got))
+	}
+
+	// A clear sent over a websocket comes after the messages before it.
+	u.Path = "/score/live"
+	u.RawQuery = "envelope"
+	publisher := subscribe(t, u, TESTORIGIN)
+	defer publisher.Close()
+	for i := 0; i < 50; i++ {
+		publisher.WriteJSON(envelope{Retain: true, Text: strconv.Itoa(i)})
+	}
+	publisher.WriteJSON(envelope{Retain: true})
+	publisher.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 50; i++ {
+		if _, _, err := publisher.ReadMessage(); err != nil {
+			t.Fatal("expected the publisher to get its messages:", err)
+		}
+	}
+	u.RawQuery = ""
+	late := subscribe(t, u, TESTORIGIN)
+	defer late.Close()
+	late.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, got, err := late.ReadMessage(); err == nil {
+		t.Fatal("unexpected message after clearing over a websocket:", string(got))
+	}
+
+	s := newRetainStore()
+	for _, path := range []string{"/a", "/b", "/a", "/c"} {
+		s.set(path, message{text: []byte(path)}, 2)
+	}
+	if _, ok := s.get("/b"); ok {
+		t.Fatal("expected the least recently retained path to be evicted")
+	}
+	if _, ok := s.get("/a"); !ok {
+		t.Fatal("expected /a to be kept")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	t.Log("TestDedup: messages repeating an idempotency key are acknowledged but not broadcast")
+	u, _ := url.Parse(server.URL)
+	u.Path = "/dedup"
+	u.Scheme = "ws"
+	u.RawQuery = "envelope"
+	ws := subscribe(t, u, TESTORIGIN)
+	defer ws.Close()
+
+	u.Scheme = "http"
+	u.RawQuery = ""
+	prefix := fmt.Sprint(rnd.Int63())
+	publish := func(body, key string) {
+		req, _ := http.NewRequest("POST", u.String(), strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", prefix+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := string(responseBody(t, resp)); resp.StatusCode != http.StatusOK || body != "OK\n" {
+			t.Fatal("expected duplicates to be acknowledged, got", resp.StatusCode, body)
+		}
+	}
+	expect := func(want envelope) {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var got envelope
+		if err := ws.ReadJSON(&got); err != nil || got.Text != want.Text || got.Key != want.Key {
+			t.Fatal("expected", want, "got", got, err)
+		}
+	}
+	publish("a", "1")
+	publish("a", "1")
+	publish("b", "2")
+	expect(envelope{Text: "a", Key: prefix + "1"})
+	expect(envelope{Text: "b", Key: prefix + "2"})
+	// The echo of an empty message shows the duplicate has been queued.
+	ws.WriteJSON(map[string]string{"text": "b again", "key": prefix + "2"})
+	ws.WriteMessage(websocket.TextMessage, nil)
+	expect(envelope{})
+	publish("end", "")
+	expect(envelope{Text: "end"})
+
+	// A path with no subscribers doesn't keep a duplicate either.
+	u.Path = "/dedup/idle"
+	for _, text := range []string{"first", "second"} {
+		req, _ := http.NewRequest("POST", u.String(), strings.NewReader(text))
+		req.Header.Set("Idempotency-Key", prefix+"3")
+		req.Header.Set("Retain", "true")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	u.Scheme = "ws"
+	idle := subscribe(t, u, TESTORIGIN)
+	defer idle.Close()
+	expectFrame(t, idle, websocket.TextMessage, []byte("first"))
+
+	d := newDedup()
+	now := time.Now()
+	if d.duplicate("k", now, time.Minute, 10) || !d.duplicate("k", now.Add(time.Second), time.Minute, 10) {
+		t.Fatal("expected a repeated key to be a duplicate within the window")
+	}
+	if d.duplicate("k", now.Add(2*time.Minute), time.Minute, 10) {
+		t.Fatal("expected a key to be forgotten after the window")
+	}
+}
+
+func TestConflate(t *testing.T) {
+	t.Log("TestConflate: a slow subscriber's held messages are replaced by newer ones with the same key")
+	cfg := newConfig()
+	cfg.Rules = rules{{Pattern: "/ticker/*", SlowConsumer: slowConflate, ConflateKey: "quote.symbol"}}
+	p := cfg.policy("/ticker/x")
+	key := func(text string) string {
+		return p.conflationKey(&parsedMessage{msg: message{text: []byte(text)}})
+	}
+	if key(`{"quote":{"symbol":"A"}}`) != `"A"` || key(`{"quote":{}}`) != "" || key("plain") != "" {
+		t.Fatal("unexpected conflation keys")
+	}
+
+	conn := &connection{send: make(chan message, 1)}
+	cf := newConflater()
+	for _, text := range []string{`{"quote":{"symbol":"A","p":1}}`, `{"quote":{"symbol":"A","p":2}}`, `{"quote":{"symbol":"B","p":1}}`, `{"quote":{"symbol":"A","p":3}}`} {
+		msg := message{text: []byte(text)}
+		cf.offer(conn, p.conflationKey(&parsedMessage{msg: msg}), msg, 2)
+	}
+	if msg := (message{text: []byte(`{"quote":{"symbol":"C"}}`)}); cf.offer(conn, `"C"`, msg, 2) {
+		t.Fatal("expected a key past the cap to be refused")
+	}
+	if msg := <-conn.send; string(msg.text) != `{"quote":{"symbol":"A","p":1}}` {
+		t.Fatal("expected the first message to be sent, got", string(msg.text))
+	}
+	select {
+	case <-cf.wake:
+	default:
+		t.Fatal("expected the writer to be woken")
+	}
+	held := cf.take()
+	if len(held) != 2 || string(held[0].text) != `{"quote":{"symbol":"A","p":3}}` || string(held[1].text) != `{"quote":{"symbol":"B","p":1}}` {
+		t.Fatal("expected the newest A then B, got", held)
+	}
+	msg := message{text: []byte("next")}
+	cf.offer(conn, "", msg, 2)
+	if len(cf.take()) != 0 || string((<-conn.send).text) != "next" {
+		t.Fatal("expected an empty conflater to send directly")
+	}
+
+	// End to end, a subscriber that stops reading gets the newest quote
+	// for each symbol once it reads again.
+	cfg = newConfig()
+	cfg.SendBufferSize = 1
+	cfg.Rules = rules{{Pattern: "/ticker/*", SlowConsumer: slowConflate, ConflateKey: "quote.symbol", Presence: true}}
+	conflated := httptest.NewUnstartedServer(testHandler(cfg))
+	conflated.Listener = smallBufferListener{conflated.Listener}
+	conflated.Start()
+	defer conflated.Close()
+	u, _ := url.Parse(conflated.URL)
+	u.Path = "/ticker/x"
+	u.Scheme = "ws"
+	ws := subscribe(t, u, "")
+	defer ws.Close()
+
+	u.Scheme = "http"
+	pad := strings.Repeat("x", 16384)
+	const quotes = 20
+	for i := 1; i <= quotes; i++ {
+		for _, symbol := range []string{"A", "B"} {
+			post(t, u, fmt.Sprintf(`{"quote":{"symbol":%q,"p":%d},"pad":%q}`, symbol, i, pad)).Body.Close()
+		}
+	}
+	// A presence query returns once the channel has handled the quotes.
+	u.RawQuery = "presence"
+	get(t, u).Body.Close()
+
+	var quote struct {
+		Quote struct {
+			Symbol string
+			P      int
+		}
+	}
+	latest := map[string]int{}
+	received := 0
+	for latest["A"] != quotes || latest["B"] != quotes {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		if err := ws.ReadJSON(&quote); err != nil {
+			t.Fatal("expected the newest quotes, got", latest, err)
+		}
+		if quote.Quote.P <= latest[quote.Quote.Symbol] {
+			t.Fatal("quotes out of order:", quote.Quote.Symbol, quote.Quote.P, "after", latest)
+		}
+		latest[quote.Quote.Symbol] = quote.Quote.P
+		received++
+	}
+	if received == 2*quotes {
+		t.Fatal("expected some quotes to be conflated")
+	}
+}
+
+// smallBufferListener shrinks the send buffers of the connections it
+// accepts, so that a client that stops reading soon stalls the server.
+type smallBufferListener struct {
+	net.Listener
+}
+
+func (l smallBufferListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetWriteBuffer(4096)
+	}
+	return c, err
+}
+
+func TestThrottle(t *testing.T) {
+	t.Log("TestThrottle: throttled paths broadcast at most one message per interval, the latest")
+	cfg := newConfig()
+	cfg.Rules = rules{
+		{Pattern: "/throttle/leading", Throttle: duration{200 * time.Millisecond}},
+		{Pattern: "/throttle/trailing", Throttle: duration{200 * time.Millisecond}, ThrottleMode: throttleTrailing},
+	}
+	throttled := httptest.NewServer(testHandler(cfg))
+	defer throttled.Close()
+	for _, tc := range []struct {
+		path string
+		want []string
+	}{
+		{"/throttle/leading", []string{"1", "3"}},
+		{"/throttle/trailing", []string{"3"}},
+	} {
+		u, _ := url.Parse(throttled.URL)
+		u.Path = tc.path
+		u.Scheme = "ws"
+		ws := subscribe(t, u, "")
+		defer ws.Close()
+		u.Scheme = "http"
+		start := time.Now()
+		for _, m := range []string{"1", "2", "3"} {
+			post(t, u, m).Body.Close()
+		}
+		for _, want := range tc.want {
+			expectFrame(t, ws, websocket.TextMessage, []byte(want))
+		}
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Fatal(tc.path, "expected the latest message at the end of the interval, got it after", elapsed)
+		}
+	}
+
+	// The trailing path's subscriber is still connected.
+	u, _ := url.Parse(throttled.URL + "/?path=/throttle/trailing")
+	if body := string(responseBody(t, post(t, u, "held"))); body != "OK 1\n" {
+		t.Fatal("expected a held multicast to count its subscriber, got", body)
+	}
+	u, _ = url.Parse(throttled.URL + "/throttle/trailing?reply")
+	if resp := post(t, u, "ping"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected 400 for a request to a throttled path, got", resp.StatusCode)
+	}
+}
+
+func TestChannelChurn(t *testing.T) {
+	t.Log("TestChannelChurn: channels closing while subscribers come and go and messages arrive")
+	h := newHub(newConfig())
+	go h.run()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				conn := newConnection(nil, h, "/churn", "", "")
+				h.queue <- command{cmd: SUBSCRIBE, conn: conn, path: conn.path}
+				channel := <-conn.control
+				channel.queue <- command{cmd: PUBLISH, path: conn.path, message: message{text: []byte("x")}}
+				channel.queue <- command{cmd: UNSUBSCRIBE, conn: conn, path: conn.path}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				reply := make(chan int, 1)
+				h.queue <- command{cmd: PUBLISH, path: "/churn", message: message{text: []byte("y")}, reply: reply}
+				<-reply
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// presence describes who is subscribed to a channel. Count is the number
+// of subscribed connections, including anonymous ones; Members lists each
+// identity once.
+type presence struct {
+	Path    string   `json:"path"`
+	Count   int      `json:"count"`
+	Members []string `json:"members"`
+}
+
+// presenceEvent is broadcast when a member joins or leaves a channel.
+type presenceEvent struct {
+	Presence string `json:"presence"` // "join" or "leave"
+	ID       string `json:"id"`
+	Count    int    `json:"count"`
+}
+
+// presence returns the channel's subscriber count and distinct members.
+func (c *channel) presence() presence {
+	p := presence{Path: c.path, Count: len(c.connections), Members: []string{}}
+	seen := make(map[string]bool)
+	for _, member := range c.connections {
+		if id := member.(string); id != "" && !seen[id] {
+			seen[id] = true
+			p.Members = append(p.Members, id)
+		}
+	}
+	sort.Strings(p.Members)
+	return p
+}
+
+// announce broadcasts a presence event to the other subscribers when the
+// first connection of a member has joined or its last connection has
+// left. Call it once conn is added to or removed from the channel, so the
+// event's count matches a presence query.
+func (c *channel) announce(event string, conn *connection) {
+	if !c.policy.presence || conn.member == "" {
+		return
+	}
+	for other, id := range c.connections {
+		if other != conn && id == conn.member {
+			return
+		}
+	}
+	text, _ := json.Marshal(presenceEvent{Presence: event, ID: conn.member, Count: len(c.connections)})
+	c.broadcast(message{text: text}, false, conn)
+}
+
+// presence asks the hub for the presence of path. A path without a
+// channel has no subscribers.
+func (h *hub) presence(path string) presence {
+	reply := make(chan presence, 1)
+	h.queue <- command{cmd: PRESENCE, path: path, presence: reply}
+	return <-reply
+}
+
+// servePresence writes the presence of r's path as JSON.
+func servePresence(h *hub, w http.ResponseWriter, r *http.Request) {
+	if !h.config().policy(r.URL.Path).presence {
+		http.Error(w, "Error: presence is not enabled for this path.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.presence(r.URL.Path))
+}
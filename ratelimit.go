@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateSpec describes a token bucket that refills at Rate tokens per second
+// and holds at most Burst tokens. A zero Rate means unlimited.
+type rateSpec struct {
+	Rate  float64
+	Burst float64
+}
+
+// rateLimit configures buckets keyed by remote IP, authenticated identity
+// and path. A request must be allowed by every configured bucket.
+type rateLimit struct {
+	IP       rateSpec
+	Identity rateSpec
+	Path     rateSpec
+}
+
+type rateLimiter struct {
+	ip       *limiter
+	identity *limiter
+	path     *limiter
+}
+
+func newRateLimiter(rl rateLimit) *rateLimiter {
+	return &rateLimiter{
+		ip:       newLimiter(rl.IP),
+		identity: newLimiter(rl.Identity),
+		path:     newLimiter(rl.Path),
+	}
+}
+
+// allow takes one token from each bucket that applies, or none if any of
+// them is empty. Empty keys are not limited.
+func (r *rateLimiter) allow(ip, identity, path string) bool {
+	var taken tokens
+	if !r.take(&taken, ip, identity, path) {
+		taken.refund()
+		return false
+	}
+	return true
+}
+
+// take takes one token from each bucket that applies, adding them to
+// taken, and reports whether every bucket had one. On false the caller
+// refunds taken.
+func (r *rateLimiter) take(taken *tokens, ip, identity, path string) bool {
+	return r.takeSender(taken, ip, identity) && r.takePath(taken, path)
+}
+
+// takeSender is take for the ip and identity buckets only.
+func (r *rateLimiter) takeSender(taken *tokens, ip, identity string) bool {
+	return r.ip.take(taken, ip) && r.identity.take(taken, identity)
+}
+
+// takePath is take for the path bucket only.
+func (r *rateLimiter) takePath(taken *tokens, path string) bool {
+	return r.path.take(taken, path)
+}
+
+// tokens are taken from buckets while checking several limits, to be
+// given back if a later one denies the request.
+type tokens []token
+
+type token struct {
+	l   *limiter
+	key string
+}
+
+func (ts tokens) refund() {
+	for _, t := range ts {
+		t.l.refund(t.key)
+	}
+}
+
+type limiter struct {
+	sync.Mutex
+	spec    rateSpec
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(spec rateSpec) *limiter {
+	if spec.Rate <= 0 {
+		return nil
+	}
+	if spec.Burst < 1 {
+		spec.Burst = math.Max(1, spec.Rate)
+	}
+	return &limiter{
+		spec:    spec,
+		buckets: make(map[string]*bucket),
+		swept:   time.Now(),
+	}
+}
+
+func (l *limiter) allow(key string) bool {
+	if l == nil || key == "" {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.spec.Burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.spec.Burst, b.tokens+now.Sub(b.last).Seconds()*l.spec.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// take is allow, adding the token to taken.
+func (l *limiter) take(taken *tokens, key string) bool {
+	if !l.allow(key) {
+		return false
+	}
+	if l != nil && key != "" {
+		*taken = append(*taken, token{l: l, key: key})
+	}
+	return true
+}
+
+// refund gives back a token taken for key.
+func (l *limiter) refund(key string) {
+	l.Lock()
+	defer l.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(l.spec.Burst, b.tokens+1)
+	}
+}
+
+// sweep forgets buckets that have refilled completely, at most once a minute.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	full := time.Duration(l.spec.Burst / l.spec.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (rl *rateLimit) String() string {
+	s := []string{}
+	for _, k := range []struct {
+		name string
+		spec rateSpec
+	}{{"ip", rl.IP}, {"identity", rl.Identity}, {"path", rl.Path}} {
+		if k.spec.Rate > 0 {
+			s = append(s, fmt.Sprintf("%s=%g:%g", k.name, k.spec.Rate, k.spec.Burst))
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses a flag value such as "ip=10:20,path=100" where each entry is
+// key=rate[:burst] with rate in events per second.
+func (rl *rateLimit) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("expected key=rate[:burst], got %q", entry)
+		}
+		rb := strings.SplitN(kv[1], ":", 2)
+		rate, err := strconv.ParseFloat(rb[0], 64)
+		if err != nil || rate < 0 {
+			return fmt.Errorf("invalid rate in %q", entry)
+		}
+		spec := rateSpec{Rate: rate}
+		if len(rb) == 2 {
+			if spec.Burst, err = strconv.ParseFloat(rb[1], 64); err != nil || spec.Burst < 0 {
+				return fmt.Errorf("invalid burst in %q", entry)
+			}
+		}
+		switch kv[0] {
+		case "ip":
+			rl.IP = spec
+		case "identity":
+			rl.Identity = spec
+		case "path":
+			rl.Path = spec
+		default:
+			return fmt.Errorf("unknown rate limit key %q (want ip, identity or path)", kv[0])
+		}
+	}
+	return nil
+}
+
+// remoteIP returns the client address, taken from IPHeader when pinghub
+// runs behind a trusted reverse proxy.
+func (c *config) remoteIP(r *http.Request) string {
+	if c.IPHeader != "" {
+		if ip := strings.TrimSpace(strings.Split(r.Header.Get(c.IPHeader), ",")[0]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// identity returns the authenticated identity set by a reverse proxy in
+// IdentityHeader, if any.
+func (c *config) identity(r *http.Request) string {
+	if c.IdentityHeader == "" {
+		return ""
+	}
+	return r.Header.Get(c.IdentityHeader)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// replyPrefix starts the ephemeral paths that carry replies to requests.
+// Websockets can't subscribe to them; responders POST their reply.
+const replyPrefix = "/.reply/"
+
+var (
+	errNoResponders = errors.New("no subscribers to answer the request")
+	errReplyTimeout = errors.New("no reply before the timeout")
+	errDropped      = errors.New("the request was expired, a duplicate or dropped by a filter")
+)
+
+func isReplyPath(path string) bool {
+	return strings.HasPrefix(path, replyPrefix)
+}
+
+// newReplyPath returns a reply path with a random, unguessable request ID.
+func newReplyPath() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return replyPrefix + hex.EncodeToString(b)
+}
+
+// replyTimeout parses the timeout query parameter, bounded by
+// MaxReplyTimeout.
+func (c *config) replyTimeout(r *http.Request) (time.Duration, error) {
+	timeout := c.ReplyTimeout.Duration
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return 0, errors.New("timeout must be a positive duration such as 5s")
+		}
+		timeout = d
+	}
+	if timeout > c.MaxReplyTimeout.Duration {
+		timeout = c.MaxReplyTimeout.Duration
+	}
+	return timeout, nil
+}
+
+// request publishes msg to path with a new reply path and waits up to
+// timeout for the first message published to the reply path. The reply
+// path is subscribed by a connection without a websocket, read here
+// instead of by a writer.
+func (h *hub) request(path string, msg message, timeout time.Duration) (message, error) {
+	conn := newConnection(nil, h, newReplyPath(), "", "")
+	h.queue <- command{cmd: SUBSCRIBE, conn: conn, path: conn.path}
+	channel := <-conn.control
+	close(conn.control)
+	defer func() {
+		channel.queue <- command{cmd: UNSUBSCRIBE, conn: conn, path: conn.path}
+	}()
+
+	msg.replyTo = conn.path
+	reached := make(chan int, 1)
+	h.queue <- command{cmd: PUBLISH, path: path, message: msg, reply: reached}
+	switch <-reached {
+	case dropped:
+		return message{}, errDropped
+	case 0:
+		return message{}, errNoResponders
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply, ok := <-conn.send:
+		if !ok {
+			return message{}, errReplyTimeout
+		}
+		return reply, nil
+	case <-timer.C:
+		return message{}, errReplyTimeout
+	}
+}
+
+// serveRequest publishes msg as a request to path and writes the reply as
+// the response body.
+func (ph postHandler) serveRequest(cfg *config, w http.ResponseWriter, r *http.Request, msg message) {
+	timeout, err := cfg.replyTimeout(r)
+	if err != nil {
+		sendBadRequestError(w, err.Error())
+		return
+	}
+	if cfg.policy(r.URL.Path).throttle > 0 {
+		// A later message could replace the request before it is sent.
+		sendBadRequestError(w, "A request can't be sent to a throttled path.")
+		return
+	}
+	mark("postmsgs", 1)
+	reply, err := ph.hub.request(r.URL.Path, msg, timeout)
+	switch err {
+	case errNoResponders:
+		http.Error(w, "Error: "+err.Error()+".", http.StatusServiceUnavailable)
+		return
+	case errDropped:
+		http.Error(w, "Error: "+err.Error()+".", http.StatusUnprocessableEntity)
+		return
+	case errReplyTimeout:
+		mark("replytimeouts", 1)
+		http.Error(w, "Error: "+err.Error()+".", http.StatusGatewayTimeout)
+		return
+	}
+	if reply.binary {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Write(reply.text)
+}
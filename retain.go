@@ -0,0 +1,90 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// retainStore keeps the last retained message of each path, even with no
+// subscribers, for new subscribers to receive first. Past max paths, the
+// path retained least recently is forgotten.
+type retainStore struct {
+	sync.Mutex
+	paths map[string]*list.Element
+	order *list.List // of *retained, least recent first
+}
+
+type retained struct {
+	path string
+	msg  message
+}
+
+func newRetainStore() *retainStore {
+	return &retainStore{
+		paths: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// set makes msg the retained message of path.
+func (s *retainStore) set(path string, msg message, max int) {
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.paths[path]; ok {
+		e.Value.(*retained).msg = msg
+		s.order.MoveToBack(e)
+		return
+	}
+	for s.order.Len() >= max {
+		oldest := s.order.Remove(s.order.Front()).(*retained)
+		delete(s.paths, oldest.path)
+	}
+	s.paths[path] = s.order.PushBack(&retained{path: path, msg: msg})
+}
+
+// clear forgets the retained message of path.
+func (s *retainStore) clear(path string) {
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.paths[path]; ok {
+		s.order.Remove(e)
+		delete(s.paths, path)
+	}
+}
+
+// get returns the retained message of path, if it has one that hasn't
+// expired.
+func (s *retainStore) get(path string) (message, bool) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.paths[path]
+	if !ok {
+		return message{}, false
+	}
+	msg := e.Value.(*retained).msg
+	if msg.expired(time.Now()) {
+		mark("expired", 1)
+		s.order.Remove(e)
+		delete(s.paths, path)
+		return message{}, false
+	}
+	return msg, true
+}
+
+// retain reports whether a POST asks for its message to be retained with
+// a Retain header.
+func retain(r *http.Request) (bool, error) {
+	s := r.Header.Get("Retain")
+	if s == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("Retain %q must be true or false", s)
+	}
+	return b, nil
+}
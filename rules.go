@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Slow-consumer policies: what a channel does when a subscriber's send
+// buffer is full.
+const (
+	slowDisconnect = "disconnect" // unsubscribe the subscriber (default)
+	slowDrop       = "drop"       // skip the message for that subscriber
+	slowConflate   = "conflate"   // hold only the newest message per key
+)
+
+// rule sets policy for paths matching Pattern. Zero fields are unset. For
+// each setting, the first matching rule that sets it wins; settings no
+// rule sets fall back to the top level config.
+type rule struct {
+	Pattern string
+
+	// MaxMessageSize overrides config.MaxMessageSize.
+	MaxMessageSize int64
+
+	// History is the number of recent messages a channel keeps and sends
+	// to each new subscriber.
+	History int
+
+	// ClientPublish, when false, stops websocket clients from publishing.
+	ClientPublish *bool
+
+	// PublishLimit rate limits publishing to matching paths, in addition
+	// to config.PublishLimit.
+	PublishLimit rateLimit
+
+	// MaxSubscribers overrides config.MaxSubscribers.
+	MaxSubscribers int
+
+	// SlowConsumer is slowDisconnect, slowDrop or slowConflate.
+	SlowConsumer string
+
+	// ConflateKey is the dotted path of the JSON field whose value keys
+	// conflated messages. Empty conflates every message.
+	ConflateKey string
+
+	// Origins override config.Origins.
+	Origins origins
+
+	// Presence broadcasts join and leave events for subscribers with an
+	// identity.
+	Presence bool
+
+	// Filters transform or drop messages before fan-out, in order.
+	Filters []filterConfig
+
+	// Durable appends messages to an on-disk log. See durability.
+	Durable bool
+
+	// GroupBalance is balanceRoundRobin or balanceLeast.
+	GroupBalance string
+
+	// Throttle caps broadcasts to one per interval, keeping the latest
+	// message.
+	Throttle duration
+
+	// ThrottleMode is throttleLeading or throttleTrailing.
+	ThrottleMode string
+
+	limiter *rateLimiter
+	filters filterChain
+}
+
+type rules []rule
+
+// policy is the resolved set of rules for one path.
+type policy struct {
+	maxMessageSize int64
+	history        int
+	clientPublish  bool
+	limiter        *rateLimiter
+	maxSubscribers int
+	slowConsumer   string
+	conflateKey    []string
+	origins        origins
+	presence       bool
+	filters        filterChain
+	durable        bool
+	groupBalance   string
+	throttle       time.Duration
+	throttleMode   string
+}
+
+// policy resolves the rules that apply to path.
+func (c *config) policy(path string) policy {
+	p := policy{}
+	var clientPublish *bool
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if !matchPath(r.Pattern, path) {
+			continue
+		}
+		if p.maxMessageSize == 0 {
+			p.maxMessageSize = r.MaxMessageSize
+		}
+		if p.history == 0 {
+			p.history = r.History
+		}
+		if clientPublish == nil {
+			clientPublish = r.ClientPublish
+		}
+		if p.limiter == nil {
+			p.limiter = r.limiter
+		}
+		if p.maxSubscribers == 0 {
+			p.maxSubscribers = r.MaxSubscribers
+		}
+		if p.slowConsumer == "" {
+			p.slowConsumer = r.SlowConsumer
+		}
+		if p.conflateKey == nil && r.ConflateKey != "" {
+			p.conflateKey = strings.Split(r.ConflateKey, ".")
+		}
+		if p.origins == nil {
+			p.origins = r.Origins
+		}
+		p.presence = p.presence || r.Presence
+		if p.filters == nil {
+			p.filters = r.filters
+		}
+		p.durable = p.durable || r.Durable
+		if p.groupBalance == "" {
+			p.groupBalance = r.GroupBalance
+		}
+		if p.throttle == 0 {
+			p.throttle = r.Throttle.Duration
+		}
+		if p.throttleMode == "" {
+			p.throttleMode = r.ThrottleMode
+		}
+	}
+	if p.maxMessageSize == 0 {
+		p.maxMessageSize = c.MaxMessageSize
+	}
+	p.clientPublish = clientPublish == nil || *clientPublish
+	if p.maxSubscribers == 0 {
+		p.maxSubscribers = c.MaxSubscribers
+	}
+	if p.slowConsumer == "" {
+		p.slowConsumer = slowDisconnect
+	}
+	if p.origins == nil {
+		p.origins = c.Origins
+	}
+	if p.groupBalance == "" {
+		p.groupBalance = balanceRoundRobin
+	}
+	if p.throttleMode == "" {
+		p.throttleMode = throttleLeading
+	}
+	return p
+}
+
+// validate reports problems with each rule through fail.
+func (rs rules) validate(fail func(format string, a ...interface{})) {
+	for _, r := range rs {
+		if _, err := path.Match(r.Pattern, ""); err != nil || r.Pattern == "" {
+			fail("Rules pattern %q is not a valid path pattern", r.Pattern)
+		}
+		if r.MaxMessageSize < 0 || r.History < 0 || r.MaxSubscribers < 0 {
+			fail("Rules %q: sizes and counts must not be negative", r.Pattern)
+		}
+		for _, spec := range []rateSpec{r.PublishLimit.IP, r.PublishLimit.Identity, r.PublishLimit.Path} {
+			if spec.Rate < 0 || spec.Burst < 0 {
+				fail("Rules %q: PublishLimit rates and bursts must not be negative", r.Pattern)
+				break
+			}
+		}
+		r.Origins.validate(fail, fmt.Sprintf("Rules %q:", r.Pattern))
+		if _, err := newFilterChain(r.Filters); err != nil {
+			fail("Rules %q: %v", r.Pattern, err)
+		}
+		switch r.SlowConsumer {
+		case "", slowDisconnect, slowDrop, slowConflate:
+		default:
+			fail("Rules %q: SlowConsumer %q must be %q, %q or %q", r.Pattern, r.SlowConsumer, slowDisconnect, slowDrop, slowConflate)
+		}
+		switch r.GroupBalance {
+		case "", balanceRoundRobin, balanceLeast:
+		default:
+			fail("Rules %q: GroupBalance %q must be %q or %q", r.Pattern, r.GroupBalance, balanceRoundRobin, balanceLeast)
+		}
+		if r.Throttle.Duration < 0 {
+			fail("Rules %q: Throttle must not be negative", r.Pattern)
+		}
+		switch r.ThrottleMode {
+		case "", throttleLeading, throttleTrailing:
+		default:
+			fail("Rules %q: ThrottleMode %q must be %q or %q", r.Pattern, r.ThrottleMode, throttleLeading, throttleTrailing)
+		}
+	}
+}
+
+// equal reports whether r and o configure the same policy.
+func (r *rule) equal(o *rule) bool {
+	a, b := *r, *o
+	a.limiter, b.limiter = nil, nil
+	a.filters, b.filters = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+func (rs *rules) String() string {
+	s := []string{}
+	for _, r := range *rs {
+		if r.MaxMessageSize > 0 {
+			s = append(s, fmt.Sprintf("%s=%d", r.Pattern, r.MaxMessageSize))
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses a pattern=size flag value into a rule that sets only
+// MaxMessageSize.
+func (rs *rules) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 1 {
+		return fmt.Errorf("expected pattern=size, got %q", value)
+	}
+	size, err := strconv.ParseInt(value[i+1:], 10, 64)
+	if err != nil || size < 1 {
+		return fmt.Errorf("invalid size in %q", value)
+	}
+	*rs = append(*rs, rule{Pattern: value[:i], MaxMessageSize: size})
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errScheduleFull = errors.New("too many scheduled messages")
+
+// scheduled is a message to publish to Path at At.
+type scheduled struct {
+	ID     string
+	Path   string
+	At     time.Time
+	Text   []byte
+	Binary bool
+	Sender string
+	TTL    time.Duration // from delivery
+	Retain bool
+	Key    string
+
+	index int // in the heap
+}
+
+// schedule is a min-heap of scheduled messages by At.
+type schedule []*scheduled
+
+func (s schedule) Len() int           { return len(s) }
+func (s schedule) Less(i, j int) bool { return s[i].At.Before(s[j].At) }
+func (s schedule) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+	s[i].index, s[j].index = i, j
+}
+func (s *schedule) Push(x interface{}) {
+	m := x.(*scheduled)
+	m.index = len(*s)
+	*s = append(*s, m)
+}
+func (s *schedule) Pop() interface{} {
+	old := *s
+	m := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return m
+}
+
+// scheduler publishes messages when they are due by injecting them into
+// the hub's queue. If file is set, each change is appended to it as a
+// journal entry, and pending messages are loaded from it at startup.
+type scheduler struct {
+	sync.Mutex
+	queue queue
+	file  string
+	due   schedule
+	byID  map[string]*scheduled
+	wake  chan struct{}
+
+	journal *os.File
+	entries int // in the journal
+}
+
+// journalEntry is one line of a schedule file: a message added, or the ID
+// of one cancelled or delivered.
+type journalEntry struct {
+	Add    *scheduled `json:",omitempty"`
+	Remove string     `json:",omitempty"`
+}
+
+// compactEntries is how many more entries than pending messages the
+// journal may hold before it is rewritten.
+const compactEntries = 1000
+
+func newScheduler(q queue, file string) *scheduler {
+	s := &scheduler{
+		queue: q,
+		file:  file,
+		byID:  make(map[string]*scheduled),
+		wake:  make(chan struct{}, 1),
+	}
+	if file == "" {
+		return s
+	}
+	if err := s.load(); err != nil {
+		// Leave the file for the operator rather than overwrite it.
+		log.Printf("schedule %s: %v; not saving scheduled messages", file, err)
+		return s
+	}
+	s.compact()
+	return s
+}
+
+// load reads the pending messages from the journal. A torn last entry,
+// left by a crash, is skipped.
+func (s *scheduler) load() error {
+	f, err := os.Open(s.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil
+		}
+		var e journalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		if e.Add != nil {
+			heap.Push(&s.due, e.Add)
+			s.byID[e.Add.ID] = e.Add
+		} else if m, ok := s.byID[e.Remove]; ok {
+			heap.Remove(&s.due, m.index)
+			delete(s.byID, m.ID)
+		}
+	}
+}
+
+// add schedules msg for path at at and returns its ID.
+func (s *scheduler) add(path string, msg message, at time.Time, ttl time.Duration, max int) (string, error) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	m := &scheduled{
+		ID:     hex.EncodeToString(b),
+		Path:   path,
+		At:     at,
+		Text:   msg.text,
+		Binary: msg.binary,
+		Sender: msg.sender,
+		TTL:    ttl,
+		Retain: msg.retain,
+		Key:    msg.key,
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(s.due) >= max {
+		return "", errScheduleFull
+	}
+	heap.Push(&s.due, m)
+	s.byID[m.ID] = m
+	s.record(journalEntry{Add: m})
+	s.poke()
+	return m.ID, nil
+}
+
+// cancel removes the message id scheduled for path, if it is still
+// pending.
+func (s *scheduler) cancel(path, id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	m, ok := s.byID[id]
+	if !ok || m.Path != path {
+		return false
+	}
+	heap.Remove(&s.due, m.index)
+	delete(s.byID, id)
+	s.record(journalEntry{Remove: id})
+	s.poke()
+	return true
+}
+
+// poke wakes run to recompute its timer.
+func (s *scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run publishes each message when it is due.
+func (s *scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		s.Lock()
+		var ready []*scheduled
+		var removed []journalEntry
+		now := time.Now()
+		for len(s.due) > 0 && !s.due[0].At.After(now) {
+			m := heap.Pop(&s.due).(*scheduled)
+			delete(s.byID, m.ID)
+			ready = append(ready, m)
+			removed = append(removed, journalEntry{Remove: m.ID})
+		}
+		wait := time.Hour
+		if len(s.due) > 0 {
+			wait = s.due[0].At.Sub(now)
+		}
+		s.record(removed...)
+		s.Unlock()
+		for _, m := range ready {
+			msg := message{text: m.Text, binary: m.Binary, sender: m.Sender, retain: m.Retain, key: m.Key}
+			if m.TTL > 0 {
+				msg.expires = time.Now().Add(m.TTL)
+			}
+			s.queue <- command{cmd: PUBLISH, path: m.Path, message: msg}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// record appends entries to the journal, if any, and compacts it once it
+// holds compactEntries more entries than there are pending messages. It is
+// called with s locked.
+func (s *scheduler) record(entries ...journalEntry) {
+	if s.journal == nil || len(entries) == 0 {
+		return
+	}
+	var b []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("schedule %s: %v", s.file, err)
+			return
+		}
+		b = append(append(b, line...), '\n')
+	}
+	if _, err := s.journal.Write(b); err != nil {
+		log.Printf("schedule %s: %v", s.file, err)
+	}
+	if s.entries += len(entries); s.entries > len(s.due)+compactEntries {
+		s.compact()
+	}
+}
+
+// compact rewrites the journal with just the pending messages and opens it
+// for appending. It is called with s locked, or before s is shared.
+func (s *scheduler) compact() {
+	if s.file == "" {
+		return
+	}
+	if s.journal != nil {
+		s.journal.Close()
+		s.journal = nil
+	}
+	var b []byte
+	for _, m := range s.due {
+		line, err := json.Marshal(journalEntry{Add: m})
+		if err != nil {
+			log.Printf("schedule %s: %v", s.file, err)
+			return
+		}
+		b = append(append(b, line...), '\n')
+	}
+	tmp := s.file + ".tmp"
+	err := os.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = os.Rename(tmp, s.file)
+	}
+	if err == nil {
+		s.journal, err = os.OpenFile(s.file, os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		log.Printf("schedule %s: %v", s.file, err)
+		return
+	}
+	s.entries = len(s.due)
+}
+
+// deliverAt returns when a POST asks for its message to be delivered, from
+// a Deliver-At header (RFC 3339 or Unix seconds) or a Delay header (a
+// duration such as "30s", or seconds). It returns false for immediate
+// delivery.
+func (c *config) deliverAt(r *http.Request) (time.Time, bool, error) {
+	at, delay := r.Header.Get("Deliver-At"), r.Header.Get("Delay")
+	now := time.Now()
+	var t time.Time
+	switch {
+	case at == "" && delay == "":
+		return t, false, nil
+	case at != "" && delay != "":
+		return t, false, errors.New("use either Deliver-At or Delay, not both")
+	case at != "":
+		if secs, err := strconv.ParseInt(at, 10, 64); err == nil {
+			t = time.Unix(secs, 0)
+		} else if t, err = time.Parse(time.RFC3339, at); err != nil {
+			return t, false, fmt.Errorf("Deliver-At %q is not an RFC 3339 time or Unix seconds", at)
+		}
+	default:
+		d, err := parseSeconds(delay)
+		if err != nil || d < 0 {
+			return t, false, fmt.Errorf("Delay %q must be a duration or seconds, not negative", delay)
+		}
+		t = now.Add(d)
+	}
+	if t.Sub(now) > c.MaxDelay.Duration {
+		return t, false, fmt.Errorf("delivery can be at most %v ahead", c.MaxDelay.Duration)
+	}
+	return t, true, nil
+}
+
+// serveSchedule schedules msg for delivery to r's path at at. Its TTL
+// starts then.
+func (ph postHandler) serveSchedule(cfg *config, w http.ResponseWriter, r *http.Request, msg message, at time.Time, ttl time.Duration) {
+	id, err := ph.hub.sched.add(r.URL.Path, msg, at, ttl, cfg.MaxScheduled)
+	if err != nil {
+		http.Error(w, "Error: "+err.Error()+".", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "OK %s\n", id)
+	mark("postmsgs", 1)
+}
+
+// cancelHandler cancels a scheduled message with a DELETE to its path
+// with its id.
+type cancelHandler struct {
+	hub *hub
+}
+
+func (ch cancelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := ch.hub.config()
+	if !validateRequest(cfg, w, r) {
+		return
+	}
+	if !cfg.cors(w, r) {
+		return
+	}
+	if !ch.hub.allowPublish(cfg.policy(r.URL.Path), cfg.remoteIP(r), cfg.identity(r), r.URL.Path) {
+		mark("publimits", 1)
+		sendTooManyRequestsError(w)
+		return
+	}
+	if !ch.hub.sched.cancel(r.URL.Path, r.URL.Query().Get("id")) {
+		http.Error(w, "Error: no such scheduled message.", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// subscriberFilter selects the messages a subscriber wants, given at
+// connect time as query parameters:
+//
+//     ?where=type=comment     JSON field equality (dotted paths for nesting)
+//     ?prefix=comment:        raw message prefix
+//
+// A message must satisfy every condition. Binary messages never match a
+// where condition.
+type subscriberFilter struct {
+	where  []fieldMatch
+	prefix []byte
+}
+
+type fieldMatch struct {
+	path  []string
+	value string
+}
+
+// newSubscriberFilter parses the filter in q. It returns nil if q has no
+// filter.
+func newSubscriberFilter(q url.Values) (*subscriberFilter, error) {
+	f := &subscriberFilter{}
+	for _, w := range q["where"] {
+		i := strings.Index(w, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("where must be field=value, got %q", w)
+		}
+		f.where = append(f.where, fieldMatch{path: strings.Split(w[:i], "."), value: w[i+1:]})
+	}
+	if p := q.Get("prefix"); p != "" {
+		f.prefix = []byte(p)
+	}
+	if len(f.where) == 0 && f.prefix == nil {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// match reports whether pm passes the filter. A nil filter passes
+// everything.
+func (f *subscriberFilter) match(pm *parsedMessage) bool {
+	if f == nil {
+		return true
+	}
+	if f.prefix != nil && !bytes.HasPrefix(pm.msg.text, f.prefix) {
+		return false
+	}
+	for _, w := range f.where {
+		if !w.match(pm.json()) {
+			return false
+		}
+	}
+	return true
+}
+
+func (w fieldMatch) match(doc interface{}) bool {
+	doc, ok := lookup(doc, w.path)
+	if !ok {
+		return false
+	}
+	switch v := doc.(type) {
+	case string:
+		return v == w.value
+	case float64, bool, nil:
+		text, _ := json.Marshal(v)
+		return string(text) == w.value
+	}
+	return false
+}
+
+// lookup returns the value at a dotted field path in a JSON document.
+func lookup(doc interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// parsedMessage decodes a message's JSON at most once for all of a
+// channel's subscriber filters.
+type parsedMessage struct {
+	msg    message
+	parsed bool
+	doc    interface{}
+}
+
+func (pm *parsedMessage) json() interface{} {
+	if !pm.parsed {
+		pm.parsed = true
+		if !pm.msg.binary {
+			json.Unmarshal(pm.msg.text, &pm.doc)
+		}
+	}
+	return pm.doc
+}
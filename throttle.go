@@ -0,0 +1,49 @@
+package main
+
+import "time"
+
+// Throttle modes: whether a throttled channel broadcasts the first message
+// after a quiet interval at once or holds it to the end of the interval.
+// Either way it broadcasts at most one message per interval, the latest.
+const (
+	throttleLeading  = "leading"  // send at once, then hold (default)
+	throttleTrailing = "trailing" // hold to the end of the interval
+)
+
+// throttle delivers msg on a throttled path, or holds it in place of any
+// message already held until the interval ends. For a held message it
+// returns the number of subscribers it is held for.
+func (c *channel) throttle(msg message) int {
+	if c.throttleTimer == nil {
+		c.throttleTimer = time.NewTimer(c.policy.throttle)
+		if c.policy.throttleMode != throttleTrailing {
+			return c.deliver(msg)
+		}
+	}
+	if c.held != nil {
+		mark("throttled", 1)
+	}
+	c.held = &msg
+	return len(c.connections)
+}
+
+// throttled returns the channel of the running throttle interval, or nil.
+func (c *channel) throttled() <-chan time.Time {
+	if c.throttleTimer == nil {
+		return nil
+	}
+	return c.throttleTimer.C
+}
+
+// release ends a throttle interval by delivering the held message, which
+// starts the next interval.
+func (c *channel) release() {
+	if c.held == nil {
+		c.throttleTimer = nil
+		return
+	}
+	msg := *c.held
+	c.held = nil
+	c.throttleTimer.Reset(c.policy.throttle)
+	c.deliver(msg)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// parseSeconds parses a header value that is a duration such as "30s" or
+// a number of seconds.
+func parseSeconds(s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a duration or seconds", s)
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// ttl returns the TTL a POST asks for with a TTL header, or zero.
+func ttl(r *http.Request) (time.Duration, error) {
+	s := r.Header.Get("TTL")
+	if s == "" {
+		return 0, nil
+	}
+	d, err := parseSeconds(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("TTL %q must be a positive duration or seconds", s)
+	}
+	return d, nil
+}
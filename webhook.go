@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Wait this long before the first retry unless RetryBackoff is set.
+const webhookBackoff = time.Second
+
+// webhookQueueMax caps the events waiting for delivery to one URL. Events
+// over the cap are dropped.
+const webhookQueueMax = 1000
+
+// Channel lifecycle events sent to webhooks.
+const (
+	eventCreate = "create" // a channel gained its first subscriber
+	eventRemove = "remove" // a channel lost its last subscriber
+)
+
+// webhook is an HTTP endpoint notified of channel lifecycle events on
+// paths matching Pattern.
+type webhook struct {
+	Pattern string
+	URL     string
+
+	// Events lists eventCreate and/or eventRemove. Empty means both.
+	Events []string
+
+	// Limit caps the rate of events sent. Events over the limit are
+	// dropped.
+	Limit rateSpec
+
+	// Retries is the number of retries after a failed delivery, waiting
+	// RetryBackoff and then twice as long after each further failure.
+	Retries      int
+	RetryBackoff duration
+
+	limiter *limiter
+	queue   *webhookQueue
+}
+
+type webhooks []webhook
+
+// webhookQueue holds the events waiting for delivery to one URL, so that
+// they are delivered one at a time, in order. Its worker runs only while
+// it has events.
+type webhookQueue struct {
+	sync.Mutex
+	events  []queuedEvent
+	running bool
+}
+
+// queuedEvent is an event waiting for delivery with the settings of the
+// webhook it was queued for, which may differ between webhooks sharing a
+// URL and across reloads.
+type queuedEvent struct {
+	wh *webhook
+	e  webhookEvent
+}
+
+// webhookEvent is the JSON body POSTed to a webhook.
+type webhookEvent struct {
+	Event     string    `json:"event"`
+	Path      string    `json:"path"`
+	Timestamp time.Time `json:"timestamp"`
+	Node      string    `json:"node"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (wh *webhook) wants(event, path string) bool {
+	if !matchPath(wh.Pattern, path) {
+		return false
+	}
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// notify queues event for path to every matching webhook without blocking
+// the caller. Each URL gets its events in order.
+func (c *config) notify(event, path string) {
+	if isReplyPath(path) {
+		return // internal
+	}
+	for i := range c.Webhooks {
+		wh := &c.Webhooks[i]
+		if !wh.wants(event, path) {
+			continue
+		}
+		if !wh.limiter.allow(wh.URL) {
+			mark("webhookdrops", 1)
+			continue
+		}
+		if !wh.queue.push(wh, webhookEvent{Event: event, Path: path, Timestamp: time.Now().UTC(), Node: c.Node}) {
+			mark("webhookdrops", 1)
+		}
+	}
+}
+
+// push queues e for delivery to wh, starting the worker if needed. It
+// returns false if the queue is full.
+func (q *webhookQueue) push(wh *webhook, e webhookEvent) bool {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.events) >= webhookQueueMax {
+		return false
+	}
+	q.events = append(q.events, queuedEvent{wh: wh, e: e})
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+	return true
+}
+
+// run delivers the queued events until there are none left.
+func (q *webhookQueue) run() {
+	for {
+		q.Lock()
+		if len(q.events) == 0 {
+			q.running = false
+			q.Unlock()
+			return
+		}
+		qe := q.events[0]
+		q.events = q.events[1:]
+		q.Unlock()
+		qe.wh.deliver(qe.e)
+	}
+}
+
+// deliver POSTs e, retrying with exponential backoff.
+func (wh *webhook) deliver(e webhookEvent) {
+	body, _ := json.Marshal(e)
+	backoff := wh.RetryBackoff.Duration
+	if backoff == 0 {
+		backoff = webhookBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		err := wh.post(body)
+		if err == nil {
+			mark("webhooks", 1)
+			return
+		}
+		if attempt >= wh.Retries {
+			log.Printf("webhook %s failed for %s %s: %v", wh.URL, e.Event, e.Path, err)
+			mark("webhookfails", 1)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (wh *webhook) post(body []byte) error {
+	resp, err := webhookClient.Post(wh.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// equal reports whether wh and o configure the same webhook.
+func (wh *webhook) equal(o *webhook) bool {
+	a, b := *wh, *o
+	a.limiter, b.limiter = nil, nil
+	a.queue, b.queue = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// validate reports problems with each webhook through fail.
+func (whs webhooks) validate(fail func(format string, a ...interface{})) {
+	for _, wh := range whs {
+		if _, err := path.Match(wh.Pattern, ""); err != nil || wh.Pattern == "" {
+			fail("Webhooks pattern %q is not a valid path pattern", wh.Pattern)
+		}
+		if u, err := url.Parse(wh.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("Webhooks %q: URL %q must be an http or https URL", wh.Pattern, wh.URL)
+		}
+		for _, e := range wh.Events {
+			if e != eventCreate && e != eventRemove {
+				fail("Webhooks %q: unknown event %q (want %s or %s)", wh.Pattern, e, eventCreate, eventRemove)
+			}
+		}
+		if wh.Retries < 0 || wh.RetryBackoff.Duration < 0 || wh.Limit.Rate < 0 || wh.Limit.Burst < 0 {
+			fail("Webhooks %q: Retries, RetryBackoff and Limit must not be negative", wh.Pattern)
+		}
+	}
+}